@@ -1,14 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/denisbrodbeck/machineid"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rainu/mqtt-executor/internal/mqtt"
 	internalConf "github.com/rainu/mqtt-executor/internal/mqtt/config"
 	"go.uber.org/zap"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 )
 
+// EnvPrefix is the prefix of all environment variables which can be used instead of flags
+const EnvPrefix = "MQTT_EXECUTOR_"
+
 type applicationConfig struct {
 	Broker       *string
 	SubscribeQOS *int
@@ -19,11 +32,28 @@ type applicationConfig struct {
 	DeviceName   *string
 	DeviceId     *string
 
-	HomeassistantEnable *bool
-	HomeassistantTopic  *string
+	TLSCaFile     *string
+	TLSCertFile   *string
+	TLSKeyFile    *string
+	TLSServerName *string
+	TLSInsecure   *bool
+
+	ProtocolVersion *int
+	MessageExpiry   *time.Duration
+
+	HomeassistantEnable  *bool
+	HomeassistantTopic   *string
+	HomeassistantStatus  *string
+	HomeassistantCleanup *bool
+
+	MaxOutputBytes *int
 
 	TopicConfigFile     *string
+	TopicConfigFormat   *string
+	TopicConfigWatch    *bool
 	TopicConfigurations internalConf.TopicConfigurations
+
+	PrintConfig *bool
 }
 
 var Config applicationConfig
@@ -44,35 +74,198 @@ func LoadConfig() {
 		DeviceName:   flag.String("device-name", fmt.Sprintf("MQTTExecutor - %s", deviceId), "The name of this device (optional)"),
 		DeviceId:     flag.String("device-id", deviceId, "A unique device id (optional)"),
 
-		HomeassistantEnable: flag.Bool("home-assistant", false, "Enable home assistant support (optional)"),
-		HomeassistantTopic:  flag.String("ha-discovery-prefix", "homeassistant/", "The mqtt topic prefix for homeassistant's discovery (optional)"),
-		TopicConfigFile:     flag.String("config", "./config.json", "The topic configuration file"),
+		TLSCaFile:     flag.String("tls-ca", "", "The CA certificate file (PEM) to verify the broker's certificate (optional)"),
+		TLSCertFile:   flag.String("tls-cert", "", "The client certificate file (PEM) for mutual TLS (optional)"),
+		TLSKeyFile:    flag.String("tls-key", "", "The client key file (PEM) for mutual TLS (optional)"),
+		TLSServerName: flag.String("tls-server-name", "", "Override the server name which is used to verify the broker's certificate (optional)"),
+		TLSInsecure:   flag.Bool("tls-insecure", false, "Skip the verification of the broker's certificate. Do not use in production! (optional)"),
+
+		ProtocolVersion: flag.Int("protocol-version", mqtt.ProtocolVersion3, "The mqtt protocol version: 3 (3.1.1) or 5 (default 3)"),
+		MessageExpiry:   flag.Duration("message-expiry", 0, "The expiry of the published sensor values and trigger results. Only used for mqtt 5. 0 means no expiry (optional)"),
+
+		HomeassistantEnable:  flag.Bool("home-assistant", false, "Enable home assistant support (optional)"),
+		HomeassistantTopic:   flag.String("ha-discovery-prefix", "homeassistant/", "The mqtt topic prefix for homeassistant's discovery (optional)"),
+		HomeassistantStatus:  flag.String("ha-status-topic", "homeassistant/status", "The mqtt topic of homeassistant's status (birth message). All discovery configs will be republished if homeassistant comes online (optional)"),
+		HomeassistantCleanup: flag.Bool("ha-cleanup", false, "Remove all homeassistant entities of this device and exit (optional)"),
+		TopicConfigFile:      flag.String("config", "./config.json", "The topic configuration file"),
+		TopicConfigWatch:     flag.Bool("config-watch", false, "Reload the topic configuration file automatically if it changes. A reload can also be triggered by SIGHUP (optional)"),
+		TopicConfigFormat:    flag.String("config-format", internalConf.FormatAuto, "The format of the topic configuration file: auto, json, yaml or toml. auto means detection by file extension (optional)"),
+
+		MaxOutputBytes: flag.Int("max-output-bytes", 0, "The maximum number of bytes of each command's output. 0 means unlimited (optional)"),
+
+		PrintConfig: flag.Bool("print-config", false, "Print the effective connection configuration (secrets are masked) and exit (optional)"),
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nEach option can also be set by environment variable (ex. %s) "+
+			"or inside the connection section of the topic configuration file.\n"+
+			"Precedence: flag > environment variable > configuration file > default\n", envName("broker"))
 	}
 	flag.Parse()
 
+	//precedence: flag > env > file > default
+	alreadySet := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		alreadySet[f.Name] = true
+	})
+	applyEnvironment(flag.CommandLine, alreadySet)
+
+	if *Config.TopicConfigFile == "" {
+		zap.L().Fatal("Topic configuration file is missing!")
+	}
+	switch *Config.TopicConfigFormat {
+	case internalConf.FormatAuto, internalConf.FormatJson, internalConf.FormatYaml, internalConf.FormatToml:
+	default:
+		zap.L().Fatal("Invalid topic configuration format!")
+	}
+
+	configuration, err := internalConf.LoadTopicConfigurationWithFormat(*Config.TopicConfigFile, *Config.TopicConfigFormat, *Config.DeviceId)
+	if err != nil {
+		zap.L().Fatal("Error while read topic configuration: %s", zap.Error(err))
+	}
+	if configuration.Connection != nil {
+		deviceId := *Config.DeviceId
+		applyConnection(flag.CommandLine, *configuration.Connection, alreadySet)
+
+		if deviceId != *Config.DeviceId {
+			//the device id is used inside the topic configuration -> we have to load it again
+			configuration, err = internalConf.LoadTopicConfigurationWithFormat(*Config.TopicConfigFile, *Config.TopicConfigFormat, *Config.DeviceId)
+			if err != nil {
+				zap.L().Fatal("Error while read topic configuration: %s", zap.Error(err))
+			}
+		}
+	}
+	Config.TopicConfigurations = configuration
+
+	if *Config.PrintConfig {
+		printConfig(os.Stdout)
+		os.Exit(0)
+	}
+
 	if *Config.Broker == "" {
 		zap.L().Fatal("Broker is missing!")
 	}
+	if *Config.ProtocolVersion != mqtt.ProtocolVersion3 && *Config.ProtocolVersion != mqtt.ProtocolVersion5 {
+		zap.L().Fatal("Invalid protocol version!")
+	}
+	if *Config.MessageExpiry < 0 || *Config.MessageExpiry%time.Second != 0 {
+		//the expiry is transferred in seconds
+		zap.L().Fatal("Invalid message expiry! It must be a whole number of seconds.")
+	}
 	if *Config.SubscribeQOS != 0 && *Config.SubscribeQOS != 1 && *Config.SubscribeQOS != 2 {
 		zap.L().Fatal("Invalid qos level!")
 	}
 	if *Config.PublishQOS != 0 && *Config.PublishQOS != 1 && *Config.PublishQOS != 2 {
 		zap.L().Fatal("Invalid qos level!")
 	}
+	if *Config.MaxOutputBytes < 0 {
+		zap.L().Fatal("Invalid max output bytes!")
+	}
 	if *Config.DeviceId == "" {
 		zap.L().Fatal("Invalid device id!")
 	}
-	if *Config.TopicConfigFile == "" {
-		zap.L().Fatal("Topic configuration file is missing!")
-	} else {
-		configuration, err := internalConf.LoadTopicConfiguration(*Config.TopicConfigFile, *Config.DeviceId)
-		if err != nil {
-			zap.L().Fatal("Error while read topic configuration: %s", zap.Error(err))
+	if Config.isTLSConfigured() {
+		if _, err := Config.buildTLSConfig(); err != nil {
+			zap.L().Fatal("Invalid tls configuration!", zap.Error(err))
 		}
-		Config.TopicConfigurations = configuration
 	}
 }
 
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// applyEnvironment sets all flags (which are not set yet) by their corresponding environment variable. The variables
+// will be removed afterwards so that they (ex. the password) will not be inherited by the executed commands.
+func applyEnvironment(flags *flag.FlagSet, alreadySet map[string]bool) {
+	flags.VisitAll(func(f *flag.Flag) {
+		value, exists := os.LookupEnv(envName(f.Name))
+		if !exists {
+			return
+		}
+		os.Unsetenv(envName(f.Name))
+
+		if alreadySet[f.Name] {
+			return
+		}
+		if err := flags.Set(f.Name, value); err != nil {
+			zap.L().Fatal("Invalid environment variable!", zap.String("name", envName(f.Name)), zap.Error(err))
+		}
+		alreadySet[f.Name] = true
+	})
+}
+
+// applyConnection sets all flags (which are not set yet) by the corresponding value of the connection configuration
+func applyConnection(flags *flag.FlagSet, connection internalConf.Connection, alreadySet map[string]bool) {
+	//the json names of the connection settings are the same as the flag names
+	content, err := json.Marshal(connection)
+	if err != nil {
+		//the "marshalling" is relatively safe - it should never appear at runtime
+		panic(err)
+	}
+
+	values := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		panic(err)
+	}
+
+	for name, value := range values {
+		flagName := strings.Replace(name, "_", "-", -1)
+		if alreadySet[flagName] {
+			continue
+		}
+
+		if err := flags.Set(flagName, fmt.Sprint(value)); err != nil {
+			zap.L().Fatal("Invalid connection configuration!", zap.String("name", name), zap.Error(err))
+		}
+		alreadySet[flagName] = true
+	}
+}
+
+// Connection returns the effective connection configuration
+func (c *applicationConfig) Connection() internalConf.Connection {
+	return internalConf.Connection{
+		Broker:              *c.Broker,
+		ProtocolVersion:     c.ProtocolVersion,
+		SubscribeQOS:        c.SubscribeQOS,
+		PublishQOS:          c.PublishQOS,
+		Username:            *c.Username,
+		Password:            *c.Password,
+		ClientId:            *c.ClientId,
+		DeviceName:          *c.DeviceName,
+		DeviceId:            *c.DeviceId,
+		TLSCaFile:           *c.TLSCaFile,
+		TLSCertFile:         *c.TLSCertFile,
+		TLSKeyFile:          *c.TLSKeyFile,
+		TLSServerName:       *c.TLSServerName,
+		TLSInsecure:         c.TLSInsecure,
+		HomeassistantEnable: c.HomeassistantEnable,
+		HomeassistantTopic:  *c.HomeassistantTopic,
+		HomeassistantStatus: *c.HomeassistantStatus,
+		MaxOutputBytes:      c.MaxOutputBytes,
+		MessageExpiry:       c.MessageExpiry.String(),
+	}
+}
+
+func printConfig(out io.Writer) {
+	connection := Config.Connection()
+	if connection.Password != "" {
+		connection.Password = "***"
+	}
+
+	content, err := json.MarshalIndent(struct {
+		Connection internalConf.Connection `json:"connection"`
+	}{connection}, "", "  ")
+	if err != nil {
+		//the "marshalling" is relatively safe - it should never appear at runtime
+		panic(err)
+	}
+	fmt.Fprintln(out, string(content))
+}
+
 func (c *applicationConfig) GetMQTTOpts(
 	onConn MQTT.OnConnectHandler,
 	onLost MQTT.ConnectionLostHandler) *MQTT.ClientOptions {
@@ -90,6 +283,12 @@ func (c *applicationConfig) GetMQTTOpts(
 		opts.SetClientID(*c.ClientId)
 	}
 
+	if c.isTLSConfigured() {
+		//the configuration was validated before, so the error can be ignored
+		opts.TLSConfig, _ = c.buildTLSConfig()
+		opts.SetConnectionAttemptHandler(c.onConnectAttempt)
+	}
+
 	if c.TopicConfigurations.Availability != nil {
 		opts.WillEnabled = true
 		opts.WillRetained = true
@@ -103,3 +302,55 @@ func (c *applicationConfig) GetMQTTOpts(
 
 	return opts
 }
+
+func (c *applicationConfig) GetMQTT5Config(
+	onConn func(),
+	onLost func(error)) (autopaho.ClientConfig, *paho.StandardRouter, error) {
+
+	brokerUrl, err := url.Parse(*c.Broker)
+	if err != nil {
+		return autopaho.ClientConfig{}, nil, fmt.Errorf("invalid broker: %w", err)
+	}
+
+	router := paho.NewStandardRouter()
+	opts := autopaho.ClientConfig{
+		BrokerUrls: []*url.URL{brokerUrl},
+		KeepAlive:  30,
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho.Connack) {
+			onConn()
+		},
+		OnConnectError: func(err error) {
+			zap.L().Warn("Error while connecting to mqtt broker.", zap.Error(err))
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:      *c.ClientId,
+			Router:        router,
+			OnClientError: onLost,
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				onLost(fmt.Errorf("disconnected by broker: reason code %d", disconnect.ReasonCode))
+			},
+		},
+	}
+	opts.PahoErrors, _ = zap.NewStdLogAt(zap.L(), zap.ErrorLevel)
+
+	if *c.Username != "" || *c.Password != "" {
+		opts.SetUsernamePassword(*c.Username, []byte(*c.Password))
+	}
+
+	if c.isTLSConfigured() {
+		if opts.TlsCfg, err = c.buildReloadingTLSConfig(); err != nil {
+			return autopaho.ClientConfig{}, nil, err
+		}
+	}
+
+	if c.TopicConfigurations.Availability != nil {
+		opts.SetWillMessage(
+			c.TopicConfigurations.Availability.Topic,
+			[]byte(c.TopicConfigurations.Availability.Payload.Unavailable),
+			byte(*c.PublishQOS),
+			true,
+		)
+	}
+
+	return opts, router, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	internalConf "github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name             string
+		args             []string
+		env              map[string]string
+		connection       internalConf.Connection
+		expectedBroker   string
+		expectedPassword string
+	}{
+		{
+			name:           "default",
+			expectedBroker: "tcp://default:1883",
+		},
+		{
+			name:             "file",
+			connection:       internalConf.Connection{Broker: "tcp://file:1883", Password: "file"},
+			expectedBroker:   "tcp://file:1883",
+			expectedPassword: "file",
+		},
+		{
+			name:             "env over file",
+			env:              map[string]string{"MQTT_EXECUTOR_BROKER": "tcp://env:1883", "MQTT_EXECUTOR_PASSWORD": "env"},
+			connection:       internalConf.Connection{Broker: "tcp://file:1883", Password: "file"},
+			expectedBroker:   "tcp://env:1883",
+			expectedPassword: "env",
+		},
+		{
+			name:             "flag over env",
+			args:             []string{"-broker", "tcp://flag:1883"},
+			env:              map[string]string{"MQTT_EXECUTOR_BROKER": "tcp://env:1883", "MQTT_EXECUTOR_PASSWORD": "env"},
+			connection:       internalConf.Connection{Broker: "tcp://file:1883", Password: "file"},
+			expectedBroker:   "tcp://flag:1883",
+			expectedPassword: "env",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestConfigPrecedence_"+tt.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			broker := flags.String("broker", "tcp://default:1883", "")
+			password := flags.String("password", "", "")
+			assert.NoError(t, flags.Parse(tt.args))
+
+			for name, value := range tt.env {
+				os.Setenv(name, value)
+				defer os.Unsetenv(name)
+			}
+
+			alreadySet := map[string]bool{}
+			flags.Visit(func(f *flag.Flag) {
+				alreadySet[f.Name] = true
+			})
+			applyEnvironment(flags, alreadySet)
+			applyConnection(flags, tt.connection, alreadySet)
+
+			assert.Equal(t, tt.expectedBroker, *broker)
+			assert.Equal(t, tt.expectedPassword, *password)
+
+			//the variables must not be inherited by the executed commands
+			_, exists := os.LookupEnv("MQTT_EXECUTOR_PASSWORD")
+			assert.False(t, exists)
+		})
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	str := func(s string) *string { return &s }
+	expiry := time.Minute
+
+	tests := []struct {
+		name     string
+		password string
+		expected string
+	}{
+		{name: "with password", password: "secret", expected: `"password": "***"`},
+		{name: "without password", password: "", expected: `"broker": "tcp://127.0.0.1:1883"`},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestPrintConfig_"+tt.name, func(t *testing.T) {
+			Config = applicationConfig{
+				Broker:              str("tcp://127.0.0.1:1883"),
+				Username:            str("user"),
+				Password:            str(tt.password),
+				ClientId:            str("mqtt-executor"),
+				DeviceName:          str("device"),
+				DeviceId:            str("D3V1C3"),
+				TLSCaFile:           str(""),
+				TLSCertFile:         str(""),
+				TLSKeyFile:          str(""),
+				TLSServerName:       str(""),
+				HomeassistantTopic:  str("homeassistant/"),
+				HomeassistantStatus: str("homeassistant/status"),
+				MessageExpiry:       &expiry,
+			}
+
+			out := bytes.Buffer{}
+			printConfig(&out)
+
+			assert.Contains(t, out.String(), tt.expected)
+			if tt.password != "" {
+				assert.NotContains(t, out.String(), tt.password)
+			} else {
+				assert.NotContains(t, out.String(), `"password"`)
+			}
+		})
+	}
+}
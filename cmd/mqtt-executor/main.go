@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"github.com/eclipse/paho.golang/autopaho"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rainu/mqtt-executor/internal/cmd"
 	"github.com/rainu/mqtt-executor/internal/mqtt"
+	internalConf "github.com/rainu/mqtt-executor/internal/mqtt/config"
 	"github.com/rainu/mqtt-executor/internal/mqtt/hassio"
 	"go.uber.org/zap"
 	"os"
@@ -16,76 +19,191 @@ import (
 var commandExecutor *cmd.CommandExecutor
 var statusWorker mqtt.StatusWorker
 var sensorWorker mqtt.SensorWorker
+var metricsWorker mqtt.MetricsWorker
 var trigger mqtt.Trigger
+var haClient *hassio.Client
 
 func main() {
 	LoadConfig()
 	commandExecutor = cmd.NewCommandExecutor()
+	commandExecutor.MaxOutputBytes = *Config.MaxOutputBytes
 	trigger.Executor = commandExecutor
+	trigger.DeviceId = *Config.DeviceId
+	trigger.MessageExpiry = *Config.MessageExpiry
 	sensorWorker.Executor = commandExecutor
+	sensorWorker.DeviceId = *Config.DeviceId
+	sensorWorker.MessageExpiry = *Config.MessageExpiry
+	metricsWorker.Executor = commandExecutor
 
 	//reacting to signals (interrupt)
 	signals := make(chan os.Signal, 1)
 	defer close(signals)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	client := MQTT.NewClient(Config.GetMQTTOpts(
-		handleOnConnection,
-		handleOnConnectionLost,
-	))
+	//reacting to reload requests (SIGHUP or file changes)
+	reloads := make(chan bool, 1)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			reloads <- true
+		}
+	}()
+
+	var client mqtt.Client
+	if *Config.ProtocolVersion == mqtt.ProtocolVersion5 {
+		client = connectV5()
+	} else {
+		client = connectV3()
+	}
 	statusWorker.MqttClient = client
 	trigger.MqttClient = client
 	sensorWorker.MqttClient = client
+	metricsWorker.MqttClient = client
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		zap.L().Fatal("Error while connecting to mqtt broker: %s", zap.Error(token.Error()))
+	topicConfig := currentTopicConfigurations()
+	if *Config.HomeassistantCleanup {
+		newHassioClient(client).RemoveDiscoveryConfig(topicConfig)
+		client.Disconnect(10 * time.Second)
+		return
 	}
 
 	//if hassio is enabled -> publish the hassio mqtt-discovery configs
 	if *Config.HomeassistantEnable {
-		haClient := hassio.Client{
-			DeviceName:  *Config.DeviceName,
-			DeviceId:    *Config.DeviceId,
-			TopicPrefix: *Config.HomeassistantTopic,
-			MqttClient:  client,
-		}
-		haClient.PublishDiscoveryConfig(Config.TopicConfigurations)
+		haClient = newHassioClient(client)
+		haClient.PublishDiscoveryConfig(topicConfig)
+		haClient.SubscribeStatus(republishStates)
 	}
 
-	if Config.TopicConfigurations.Availability != nil {
-		statusWorker.Initialise(*Config.TopicConfigurations.Availability)
+	if topicConfig.Availability != nil {
+		statusWorker.Initialise(*topicConfig.Availability)
 	}
 
+	applyLimits(topicConfig.Limits)
+
 	//register trigger and sensors
-	trigger.Initialise(byte(*Config.SubscribeQOS), byte(*Config.PublishQOS), Config.TopicConfigurations.Trigger)
-	sensorWorker.Initialise(byte(*Config.PublishQOS), Config.TopicConfigurations.Sensors())
+	trigger.Initialise(byte(*Config.SubscribeQOS), byte(*Config.PublishQOS), topicConfig.Trigger)
+	sensorWorker.Initialise(byte(*Config.PublishQOS), topicConfig)
+
+	if *Config.TopicConfigWatch {
+		watcher, err := watchConfigFile(*Config.TopicConfigFile, reloads)
+		if err != nil {
+			zap.L().Fatal("Error while watching topic configuration file: %s", zap.Error(err))
+		}
+		defer watcher.Close()
+	}
 
-	// wait for interrupt
-	<-signals
+	// wait for interrupt (and reload if requested)
+	for {
+		select {
+		case <-reloads:
+			reloadTopicConfiguration()
+		case <-signals:
+			shutdown(client)
+			return
+		}
+	}
+}
 
-	shutdown(client)
+func newHassioClient(client mqtt.Client) *hassio.Client {
+	return &hassio.Client{
+		DeviceName:  *Config.DeviceName,
+		DeviceId:    *Config.DeviceId,
+		TopicPrefix: *Config.HomeassistantTopic,
+		StatusTopic: *Config.HomeassistantStatus,
+		MqttClient:  client,
+	}
 }
 
-var handleOnConnection = func(client MQTT.Client) {
+func connectV3() mqtt.Client {
+	client := MQTT.NewClient(Config.GetMQTTOpts(
+		func(MQTT.Client) {
+			handleOnConnection()
+		},
+		func(_ MQTT.Client, err error) {
+			handleOnConnectionLost(err)
+		},
+	))
+
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		zap.L().Fatal("Error while connecting to mqtt broker: %s", zap.Error(token.Error()))
+	}
+
+	return mqtt.NewClientV3(client)
+}
+
+func connectV5() mqtt.Client {
+	opts, router, err := Config.GetMQTT5Config(handleOnConnection, handleOnConnectionLost)
+	if err != nil {
+		zap.L().Fatal("Invalid connection configuration!", zap.Error(err))
+	}
+
+	connection, err := autopaho.NewConnection(context.Background(), opts)
+	if err != nil {
+		zap.L().Fatal("Error while connecting to mqtt broker: %s", zap.Error(err))
+	}
+
+	//the connection manager tries to reconnect forever -> we have to give up at some time
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := connection.AwaitConnection(ctx); err != nil {
+		zap.L().Fatal("Error while connecting to mqtt broker: %s", zap.Error(err))
+	}
+
+	return mqtt.NewClientV5(connection, router)
+}
+
+// applyLimits sets the execution limits of the executor and (re)starts the publishing of its metrics
+func applyLimits(limits *internalConf.Limits) {
+	if err := metricsWorker.Close(5 * time.Second); err != nil {
+		zap.L().Error("Timeout while waiting for the metrics worker!", zap.Error(err))
+	}
+
+	if limits == nil {
+		commandExecutor.SetLimits(0, nil)
+		return
+	}
+
+	commandExecutor.SetLimits(limits.MaxConcurrency, limits.Groups)
+	if limits.Metrics != nil {
+		metricsWorker.Initialise(byte(*Config.PublishQOS), *limits.Metrics)
+	}
+}
+
+var handleOnConnection = func() {
 	if !trigger.IsInitialised() {
 		return
 	}
 
 	zap.L().Info("Reinitialise...")
 	trigger.ReInitialise()
+
+	if haClient != nil {
+		//home assistant could have missed our messages while we were disconnected
+		haClient.SubscribeStatus(republishStates)
+		haClient.RepublishDiscoveryConfig()
+		sensorWorker.Republish()
+	}
+}
+
+// republishStates publishes the current sensor values and trigger states again
+func republishStates() {
+	sensorWorker.Republish()
+	trigger.RepublishStatus()
 }
 
-var handleOnConnectionLost = func(client MQTT.Client, err error) {
+var handleOnConnectionLost = func(err error) {
 	zap.L().Warn("Connection lost to broker.", zap.Error(err))
 }
 
-func shutdown(client MQTT.Client) {
+func shutdown(client mqtt.Client) {
 	zap.L().Info("Shutting down...")
 
 	type closable interface {
 		Close(time.Duration) error
 	}
-	closeables := []closable{&statusWorker, &sensorWorker, &trigger, commandExecutor}
+	closeables := []closable{&statusWorker, &sensorWorker, &trigger, &metricsWorker, commandExecutor}
 
 	//most operating systems wait a maximum of 30 seconds
 
@@ -105,5 +223,5 @@ func shutdown(client MQTT.Client) {
 	wg.Wait()
 
 	//we have to disconnect at last because one closeable unsubscripe all topics
-	client.Disconnect(10 * 1000) //wait 10sek at most
+	client.Disconnect(10 * time.Second) //wait 10sek at most
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	internalConf "github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"go.uber.org/zap"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// topicConfigLock guards the topic configuration which will be replaced on reload
+var topicConfigLock sync.RWMutex
+
+// currentTopicConfigurations returns the current (maybe reloaded) topic configuration
+func currentTopicConfigurations() internalConf.TopicConfigurations {
+	topicConfigLock.RLock()
+	defer topicConfigLock.RUnlock()
+
+	return Config.TopicConfigurations
+}
+
+func reloadTopicConfiguration() {
+	zap.L().Info("Reload topic configuration...")
+
+	//only one reload at the same time
+	topicConfigLock.Lock()
+	defer topicConfigLock.Unlock()
+
+	configuration, err := internalConf.LoadTopicConfigurationWithFormat(*Config.TopicConfigFile, *Config.TopicConfigFormat, *Config.DeviceId)
+	if err != nil {
+		//keep the current configuration
+		zap.L().Error("Error while read topic configuration. Configuration will not be reloaded!", zap.Error(err))
+		return
+	}
+
+	if !reflect.DeepEqual(configuration.Availability, Config.TopicConfigurations.Availability) {
+		//the availability is part of the connection (last will) -> we would have to reconnect
+		zap.L().Warn("The availability configuration can not be reloaded. Restart is required!")
+		configuration.Availability = Config.TopicConfigurations.Availability
+	}
+
+	if !reflect.DeepEqual(configuration.Connection, Config.TopicConfigurations.Connection) {
+		zap.L().Warn("The connection configuration can not be reloaded. Restart is required!")
+		configuration.Connection = Config.TopicConfigurations.Connection
+	}
+
+	applyLimits(configuration.Limits)
+	trigger.Reload(configuration.Trigger)
+	sensorWorker.Reload(configuration)
+	if haClient != nil {
+		haClient.UpdateDiscoveryConfig(configuration)
+	}
+
+	Config.TopicConfigurations = configuration
+}
+
+// watchConfigFile notifies the given channel if the configuration file was changed
+func watchConfigFile(configFilePath string, reload chan<- bool) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	//we have to watch the directory because the most editors replace the file instead of writing into it
+	configFilePath = filepath.Clean(configFilePath)
+	if err := watcher.Add(filepath.Dir(configFilePath)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		//collect multiple events (ex. truncate and write) to one reload
+		var debounce <-chan time.Time
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == configFilePath && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					debounce = time.After(500 * time.Millisecond)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				zap.L().Warn("Error while watching the topic configuration file.", zap.Error(err))
+			case <-debounce:
+				debounce = nil
+				reload <- true
+			}
+		}
+	}()
+
+	return watcher, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/url"
+)
+
+func (c *applicationConfig) isTLSConfigured() bool {
+	return *c.TLSCaFile != "" || *c.TLSCertFile != "" || *c.TLSKeyFile != "" || *c.TLSServerName != "" || *c.TLSInsecure
+}
+
+// buildTLSConfig reads the certificate files and generates the corresponding tls configuration. It will be called
+// before each connection attempt so that rotated certificates will be picked up without restart.
+func (c *applicationConfig) buildTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         *c.TLSServerName,
+		InsecureSkipVerify: *c.TLSInsecure,
+	}
+
+	if *c.TLSCaFile != "" {
+		caCert, err := ioutil.ReadFile(*c.TLSCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca file: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("could not read ca file: no certificate found")
+		}
+	}
+
+	if *c.TLSCertFile != "" || *c.TLSKeyFile != "" {
+		if *c.TLSCertFile == "" || *c.TLSKeyFile == "" {
+			return nil, errors.New("client certificate and key must be given together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(*c.TLSCertFile, *c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// buildReloadingTLSConfig generates a tls configuration which reads the client certificate again on each handshake.
+// This is used for MQTT 5 where the tls configuration can not be changed for each connection attempt.
+func (c *applicationConfig) buildReloadingTLSConfig() (*tls.Config, error) {
+	tlsConfig, err := c.buildTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tlsConfig.Certificates) > 0 {
+		tlsConfig.Certificates = nil
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(*c.TLSCertFile, *c.TLSKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+func (c *applicationConfig) onConnectAttempt(broker *url.URL, tlsConfig *tls.Config) *tls.Config {
+	newConfig, err := c.buildTLSConfig()
+	if err != nil {
+		//use the last valid configuration
+		zap.L().Error("Error while reloading the tls configuration!", zap.Error(err))
+		return tlsConfig
+	}
+	return newConfig
+}
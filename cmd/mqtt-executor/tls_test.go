@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// generateCert generates a certificate (signed by the given parent or self-signed) and writes it into the given directory
+func generateCert(t *testing.T, dir, name string, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	result := testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	assert.NoError(t, ioutil.WriteFile(result.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(result.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return result
+}
+
+func tlsTestConfig(caFile, certFile, keyFile, serverName string, insecure bool) *applicationConfig {
+	return &applicationConfig{
+		TLSCaFile:     &caFile,
+		TLSCertFile:   &certFile,
+		TLSKeyFile:    &keyFile,
+		TLSServerName: &serverName,
+		TLSInsecure:   &insecure,
+	}
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBuildTLSConfig")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := generateCert(t, dir, "ca", nil)
+	client := generateCert(t, dir, "client", &ca)
+
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	assert.NoError(t, ioutil.WriteFile(invalidFile, []byte("invalid"), 0600))
+
+	tests := []struct {
+		name          string
+		config        *applicationConfig
+		expectedError string
+		check         func(t *testing.T, tlsConfig *tls.Config)
+	}{
+		{
+			name:   "ca",
+			config: tlsTestConfig(ca.certFile, "", "", "", false),
+			check: func(t *testing.T, tlsConfig *tls.Config) {
+				//the client certificate is signed by the ca -> it must be verifiable with the configured pool
+				_, err := client.cert.Verify(x509.VerifyOptions{
+					Roots:     tlsConfig.RootCAs,
+					KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+				})
+				assert.NoError(t, err)
+				assert.Empty(t, tlsConfig.Certificates)
+				assert.False(t, tlsConfig.InsecureSkipVerify)
+			},
+		},
+		{
+			name:   "client certificate",
+			config: tlsTestConfig("", client.certFile, client.keyFile, "", false),
+			check: func(t *testing.T, tlsConfig *tls.Config) {
+				assert.Nil(t, tlsConfig.RootCAs)
+				assert.Len(t, tlsConfig.Certificates, 1)
+				assert.Equal(t, client.cert.Raw, tlsConfig.Certificates[0].Certificate[0])
+			},
+		},
+		{
+			name:   "ca and client certificate with server name",
+			config: tlsTestConfig(ca.certFile, client.certFile, client.keyFile, "broker.local", false),
+			check: func(t *testing.T, tlsConfig *tls.Config) {
+				assert.NotNil(t, tlsConfig.RootCAs)
+				assert.Len(t, tlsConfig.Certificates, 1)
+				assert.Equal(t, "broker.local", tlsConfig.ServerName)
+			},
+		},
+		{
+			name:   "insecure",
+			config: tlsTestConfig("", "", "", "", true),
+			check: func(t *testing.T, tlsConfig *tls.Config) {
+				assert.True(t, tlsConfig.InsecureSkipVerify)
+				assert.Nil(t, tlsConfig.RootCAs)
+			},
+		},
+		{
+			name:          "missing ca file",
+			config:        tlsTestConfig(filepath.Join(dir, "missing.pem"), "", "", "", false),
+			expectedError: "could not read ca file: open " + filepath.Join(dir, "missing.pem"),
+		},
+		{
+			name:          "invalid ca file",
+			config:        tlsTestConfig(invalidFile, "", "", "", false),
+			expectedError: "could not read ca file: no certificate found",
+		},
+		{
+			name:          "certificate without key",
+			config:        tlsTestConfig("", client.certFile, "", "", false),
+			expectedError: "client certificate and key must be given together",
+		},
+		{
+			name:          "key of another certificate",
+			config:        tlsTestConfig("", client.certFile, ca.keyFile, "", false),
+			expectedError: "could not read client certificate: tls: private key does not match public key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestBuildTLSConfig_"+tt.name, func(t *testing.T) {
+			assert.True(t, tt.config.isTLSConfigured())
+
+			tlsConfig, err := tt.config.buildTLSConfig()
+			if tt.expectedError != "" {
+				//the os specific details are not compared
+				assert.Error(t, err)
+				assert.True(t, strings.HasPrefix(err.Error(), tt.expectedError), err.Error())
+			} else {
+				assert.NoError(t, err)
+				tt.check(t, tlsConfig)
+			}
+		})
+	}
+}
+
+func TestBuildReloadingTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBuildReloadingTLSConfig")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := generateCert(t, dir, "ca", nil)
+	client := generateCert(t, dir, "client", &ca)
+	config := tlsTestConfig(ca.certFile, client.certFile, client.keyFile, "", false)
+
+	tlsConfig, err := config.buildReloadingTLSConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, tlsConfig.Certificates)
+
+	cert, err := tlsConfig.GetClientCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, client.cert.Raw, cert.Certificate[0])
+
+	//the certificate is rotated -> the new one must be used on the next handshake
+	rotated := generateCert(t, dir, "client", &ca)
+	assert.NotEqual(t, client.cert.Raw, rotated.cert.Raw)
+
+	cert, err = tlsConfig.GetClientCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, rotated.cert.Raw, cert.Certificate[0])
+
+	//the same applies for mqtt 3 (where the config is rebuilt before each connection attempt)
+	newConfig := config.onConnectAttempt(nil, nil)
+	assert.Equal(t, rotated.cert.Raw, newConfig.Certificates[0].Certificate[0])
+
+	//invalid files -> the last valid configuration will be used
+	assert.NoError(t, ioutil.WriteFile(client.keyFile, []byte("invalid"), 0600))
+	_, err = tlsConfig.GetClientCertificate(nil)
+	assert.Error(t, err)
+	assert.Same(t, newConfig, config.onConnectAttempt(nil, newConfig))
+}
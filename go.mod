@@ -3,8 +3,13 @@ module github.com/rainu/mqtt-executor
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/denisbrodbeck/machineid v1.0.1
+	github.com/eclipse/paho.golang v0.11.0
 	github.com/eclipse/paho.mqtt.golang v1.4.2
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/stretchr/testify v1.8.1
 	go.uber.org/zap v1.23.0
+	gopkg.in/yaml.v3 v3.0.1
 )
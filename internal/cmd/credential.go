@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+type credential struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+}
+
+// ValidateCredential checks if the given user and groups exist
+func ValidateCredential(userName, groupName string, groupNames []string) error {
+	_, err := lookupCredential(userName, groupName, groupNames)
+	return err
+}
+
+func lookupCredential(userName, groupName string, groupNames []string) (*credential, error) {
+	if userName == "" && groupName == "" && len(groupNames) == 0 {
+		//nothing to change
+		return nil, nil
+	}
+
+	var u *user.User
+	var err error
+	if userName != "" {
+		u, err = user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return nil, fmt.Errorf("unknown user: %s", userName)
+			}
+		}
+	} else {
+		//keep our own user
+		if u, err = user.Current(); err != nil {
+			return nil, fmt.Errorf("could not determine current user: %w", err)
+		}
+	}
+
+	cred := &credential{}
+	if cred.uid, err = parseId(u.Uid); err != nil {
+		return nil, err
+	}
+
+	//if no group is given, the primary group of the user is used
+	gid := u.Gid
+	if groupName != "" {
+		if gid, err = lookupGroupId(groupName); err != nil {
+			return nil, err
+		}
+	}
+	if cred.gid, err = parseId(gid); err != nil {
+		return nil, err
+	}
+
+	//if no supplementary groups are given, the groups of the user are used
+	var groupIds []string
+	if len(groupNames) > 0 {
+		for _, name := range groupNames {
+			groupId, err := lookupGroupId(name)
+			if err != nil {
+				return nil, err
+			}
+			groupIds = append(groupIds, groupId)
+		}
+	} else if userName != "" {
+		//if the groups could not be determined, the process will have no supplementary groups
+		groupIds, _ = u.GroupIds()
+	}
+	for _, groupId := range groupIds {
+		id, err := parseId(groupId)
+		if err != nil {
+			return nil, err
+		}
+		cred.groups = append(cred.groups, id)
+	}
+
+	return cred, nil
+}
+
+func lookupGroupId(groupName string) (string, error) {
+	g, err := user.LookupGroup(groupName)
+	if err != nil {
+		if g, err = user.LookupGroupId(groupName); err != nil {
+			return "", fmt.Errorf("unknown group: %s", groupName)
+		}
+	}
+	return g.Gid, nil
+}
+
+func parseId(id string) (uint32, error) {
+	parsed, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, errors.New("user and group ids must be numeric")
+	}
+	return uint32(parsed), nil
+}
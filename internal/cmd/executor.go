@@ -1,55 +1,255 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"go.uber.org/zap"
+	"io"
+	"os"
 	"os/exec"
 	"strings"
 	"sync"
 	"time"
 )
 
+const DefaultGracePeriod = 5 * time.Second
+
 type CommandExecutor struct {
 	lock           sync.RWMutex
 	usedContext    map[context.Context]context.CancelFunc
 	openExecutions sync.WaitGroup
+	pool           *workerPool
+
+	//the default output limit (in bytes) for stdout and stderr of each execution (0 means unlimited)
+	MaxOutputBytes int
 }
 
 func NewCommandExecutor() *CommandExecutor {
 	return &CommandExecutor{
 		lock:        sync.RWMutex{},
 		usedContext: map[context.Context]context.CancelFunc{},
+		pool:        newWorkerPool(),
 	}
 }
 
+// SetLimits limits the number of concurrent executions. The maxConcurrency is the global limit (0 means unlimited)
+// and the groupLimits are the limits for the executions of a specific LimitGroup.
+func (c *CommandExecutor) SetLimits(maxConcurrency int, groupLimits map[string]int) {
+	c.pool.setLimits(maxConcurrency, groupLimits)
+}
+
+// Metrics returns the current statistics of the executor's worker pool
+func (c *CommandExecutor) Metrics() Metrics {
+	return c.pool.metrics()
+}
+
+// Execution describes a single command execution.
+type Execution struct {
+	Name      string
+	Arguments []string
+
+	//additional environment variables (KEY=VALUE) for the process
+	Environment []string
+
+	//if true the process will not inherit the environment of this process
+	CleanEnvironment bool
+
+	//the working directory of the process (empty means the current directory)
+	WorkingDir string
+
+	//the umask of the process (nil means the umask of this process)
+	Umask *int
+
+	//the user, group and supplementary groups (names or ids) the process should run with
+	User   string
+	Group  string
+	Groups []string
+
+	//will be piped into the process' stdin (if not nil)
+	Stdin []byte
+
+	//the execution will be cancelled after this time (0 means no timeout)
+	Timeout time.Duration
+
+	//the time between SIGTERM and SIGKILL on cancellation (0 means DefaultGracePeriod)
+	GracePeriod time.Duration
+
+	//the output limit (in bytes) for stdout and stderr (0 means the executor's default)
+	MaxOutputBytes int
+
+	//which part of the output should be kept if the limit is exceeded: TruncateHead (default) or TruncateTail
+	Truncate string
+
+	//the limit group of the execution (see CommandExecutor.SetLimits)
+	LimitGroup string
+
+	//waiting executions with a higher priority will be started first (see PriorityLow and PriorityHigh)
+	Priority int
+
+	//will be called when the execution got a free slot of the worker pool and the process is about to start (if not nil)
+	StartHandler func()
+
+	//will be called for each line of stdout and stderr while the command is running (if not nil)
+	//the handler have to be thread-safe because stdout and stderr are read concurrently
+	OutputHandler func(line []byte)
+}
+
+// Result contains the outcome of a command execution.
+type Result struct {
+	//the (trimmed) combined output of stdout and stderr
+	Output []byte
+	Stdout []byte
+	Stderr []byte
+
+	//the exit code of the process (-1 if the process was not started or killed by a signal)
+	ExitCode  int
+	StartedAt time.Time
+	Duration  time.Duration
+}
+
 func (c *CommandExecutor) ExecuteCommand(cmd string, args []string) ([]byte, error) {
 	return c.ExecuteCommandWithContext(cmd, args, context.Background())
 }
 
 func (c *CommandExecutor) ExecuteCommandWithContext(cmd string, args []string, executionContext context.Context) ([]byte, error) {
+	result, err := c.ExecuteWithContext(Execution{Name: cmd, Arguments: args}, executionContext)
+	return result.Output, err
+}
+
+func (c *CommandExecutor) ExecuteWithContext(execution Execution, executionContext context.Context) (Result, error) {
 	//register the context so that we have a chance to cancel the commands later
 	ctx := c.registerContext(executionContext)
 	c.openExecutions.Add(1)
 	defer c.openExecutions.Done()
 	defer c.releaseContext(ctx)
 
-	command := exec.CommandContext(ctx, cmd, args...)
-	out, execErr := command.CombinedOutput()
+	//the timeout includes the time waiting for a free slot
+	if execution.Timeout > 0 {
+		var cancelFunc context.CancelFunc
+		ctx, cancelFunc = context.WithTimeout(ctx, execution.Timeout)
+		defer cancelFunc()
+	}
+
+	//wait for a free slot in the worker pool
+	release, err := c.pool.acquire(ctx, execution.LimitGroup, execution.Priority)
+	if err != nil {
+		zap.L().Info("Command execution cancelled before start.", zap.String("command", execution.Name))
+		return Result{ExitCode: -1}, err
+	}
+	defer release()
+
+	if execution.StartHandler != nil {
+		execution.StartHandler()
+	}
+
+	command := exec.Command(execution.Name, execution.Arguments...)
+	prepareProcess(command)
+	if execution.CleanEnvironment {
+		command.Env = append([]string{}, execution.Environment...)
+	} else if len(execution.Environment) > 0 {
+		command.Env = append(os.Environ(), execution.Environment...)
+	}
+	command.Dir = execution.WorkingDir
+
+	cred, err := lookupCredential(execution.User, execution.Group, execution.Groups)
+	if err == nil && cred != nil {
+		err = applyCredential(command, cred)
+	}
+	if err != nil {
+		zap.L().Error("Could not change user of command.", zap.Error(err))
+		return Result{ExitCode: -1}, err
+	}
+	if execution.Stdin != nil {
+		command.Stdin = bytes.NewReader(execution.Stdin)
+	}
+
+	maxOutputBytes := execution.MaxOutputBytes
+	if maxOutputBytes <= 0 {
+		maxOutputBytes = c.MaxOutputBytes
+	}
+
+	//the buffers are limited so that the memory stays bounded even if the command produces a lot of output
+	combined := &limitedBuffer{limit: maxOutputBytes, strategy: execution.Truncate}
+	stdout := &limitedBuffer{limit: maxOutputBytes, strategy: execution.Truncate}
+	stderr := &limitedBuffer{limit: maxOutputBytes, strategy: execution.Truncate}
+	combinedWriter := &sharedWriter{target: combined}
+	command.Stdout = io.MultiWriter(stdout, combinedWriter)
+	command.Stderr = io.MultiWriter(stderr, combinedWriter)
+
+	if execution.OutputHandler != nil {
+		//each stream needs its own line buffer
+		stdoutLines := &lineWriter{handler: execution.OutputHandler, maxLength: maxOutputBytes}
+		stderrLines := &lineWriter{handler: execution.OutputHandler, maxLength: maxOutputBytes}
+		defer stdoutLines.Flush()
+		defer stderrLines.Flush()
+
+		command.Stdout = io.MultiWriter(command.Stdout, stdoutLines)
+		command.Stderr = io.MultiWriter(command.Stderr, stderrLines)
+	}
+
+	result := Result{ExitCode: -1, StartedAt: time.Now()}
+	execErr := startProcess(command, execution.Umask)
+	if execErr == nil {
+		done := make(chan bool)
+		go c.watchProcess(ctx, command, execution.GracePeriod, done)
 
-	if len(out) > 0 {
-		//trim combined output
-		out = []byte(strings.Trim(string(out), " \n"))
+		execErr = command.Wait()
+		close(done)
+
+		result.ExitCode = command.ProcessState.ExitCode()
 	}
+	result.Duration = time.Since(result.StartedAt)
+	result.Output = trim(combined.Bytes())
+	result.Stdout = trim(stdout.Bytes())
+	result.Stderr = trim(stderr.Bytes())
 
 	if execErr != nil && ctx.Err() == nil {
 		zap.L().Error("Command execution failed.", zap.Error(execErr))
+	} else if ctx.Err() == context.DeadlineExceeded {
+		zap.L().Warn("Command execution timed out.", zap.String("command", execution.Name))
+		return result, ctx.Err()
 	} else if ctx.Err() != nil {
 		zap.L().Info("Command execution cancelled.")
-		return out, ctx.Err()
+		return result, ctx.Err()
+	}
+
+	return result, execErr
+}
+
+func trim(output []byte) []byte {
+	if len(output) == 0 {
+		return output
 	}
+	return []byte(strings.Trim(string(output), " \n"))
+}
 
-	return out, execErr
+// watchProcess terminates the process (and its children) as soon as the context is done
+func (c *CommandExecutor) watchProcess(ctx context.Context, command *exec.Cmd, gracePeriod time.Duration, done chan bool) {
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultGracePeriod
+	}
+
+	//first we ask politely...
+	if err := terminateProcess(command); err != nil {
+		zap.L().Debug("Could not terminate process.", zap.Error(err))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(gracePeriod):
+		//... then we kill them all
+		zap.L().Warn("Process does not terminate in time. Kill it!", zap.String("command", command.Path))
+		if err := killProcess(command); err != nil {
+			zap.L().Error("Could not kill process.", zap.Error(err))
+		}
+	}
 }
 
 func (c *CommandExecutor) registerContext(parentContext context.Context) context.Context {
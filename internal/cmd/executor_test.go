@@ -0,0 +1,117 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandExecutor_Timeout(t *testing.T) {
+	executor := NewCommandExecutor()
+
+	start := time.Now()
+	result, err := executor.ExecuteWithContext(Execution{
+		Name:      "sh",
+		Arguments: []string{"-c", "sleep 5"},
+		Timeout:   100 * time.Millisecond,
+	}, context.Background())
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, -1, result.ExitCode)
+	assert.True(t, time.Since(start) < 2*time.Second, "duration: %s", time.Since(start))
+}
+
+func TestCommandExecutor_KillAfterGracePeriod(t *testing.T) {
+	executor := NewCommandExecutor()
+
+	start := time.Now()
+	result, err := executor.ExecuteWithContext(Execution{
+		Name:        "sh",
+		Arguments:   []string{"-c", `trap "" TERM; sleep 5`},
+		Timeout:     100 * time.Millisecond,
+		GracePeriod: 300 * time.Millisecond,
+	}, context.Background())
+	duration := time.Since(start)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, -1, result.ExitCode)
+
+	//the process ignores SIGTERM -> it must be killed after the grace period
+	assert.True(t, duration >= 400*time.Millisecond, "duration: %s", duration)
+	assert.True(t, duration < 2*time.Second, "duration: %s", duration)
+}
+
+func TestCommandExecutor_Cancel(t *testing.T) {
+	executor := NewCommandExecutor()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	_, err := executor.ExecuteWithContext(Execution{Name: "sleep", Arguments: []string{"5"}}, ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestCommandExecutor_ProcessSettings(t *testing.T) {
+	os.Setenv("MQTT_EXECUTOR_TEST_INHERITED", "inherited")
+	defer os.Unsetenv("MQTT_EXECUTOR_TEST_INHERITED")
+
+	workingDir, err := ioutil.TempDir("", "TestCommandExecutor_ProcessSettings")
+	assert.NoError(t, err)
+	defer os.RemoveAll(workingDir)
+	umask := 0027
+
+	tests := []struct {
+		name        string
+		execution   Execution
+		contains    []string
+		notContains []string
+	}{
+		{
+			name:      "environment",
+			execution: Execution{Environment: []string{"MY_VAR=my value"}},
+			contains:  []string{"MY_VAR=my value", "MQTT_EXECUTOR_TEST_INHERITED=inherited"},
+		},
+		{
+			name:        "clean environment",
+			execution:   Execution{Environment: []string{"MY_VAR=my value"}, CleanEnvironment: true},
+			contains:    []string{"MY_VAR=my value"},
+			notContains: []string{"MQTT_EXECUTOR_TEST_INHERITED=inherited"},
+		},
+		{
+			name:      "working directory",
+			execution: Execution{WorkingDir: workingDir},
+			contains:  []string{"pwd=" + workingDir},
+		},
+		{
+			name:      "umask",
+			execution: Execution{Umask: &umask},
+			contains:  []string{"umask=0027"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestCommandExecutor_ProcessSettings_"+tt.name, func(t *testing.T) {
+			execution := tt.execution
+			execution.Name = "/bin/sh"
+			execution.Arguments = []string{"-c", `echo "pwd=$(pwd)"; echo "umask=$(umask)"; env`}
+
+			result, err := NewCommandExecutor().ExecuteWithContext(execution, context.Background())
+			assert.NoError(t, err)
+
+			lines := strings.Split(string(result.Output), "\n")
+			for _, expected := range tt.contains {
+				assert.Contains(t, lines, expected)
+			}
+			for _, unexpected := range tt.notContains {
+				assert.NotContains(t, lines, unexpected)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// sharedWriter can be used by multiple goroutines (stdout and stderr are copied concurrently)
+type sharedWriter struct {
+	lock   sync.Mutex
+	target io.Writer
+}
+
+func (s *sharedWriter) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.target.Write(p)
+}
+
+// lineWriter calls the handler for each complete line which was written. Lines which are longer than
+// maxLength (if greater than 0) will be split.
+type lineWriter struct {
+	handler   func(line []byte)
+	maxLength int
+	buffer    []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.buffer = append(l.buffer, p...)
+
+	for {
+		i := bytes.IndexByte(l.buffer, '\n')
+		if l.maxLength > 0 && (i < 0 || i > l.maxLength) && len(l.buffer) >= l.maxLength {
+			//the line is too long -> split it
+			l.handler(l.buffer[:l.maxLength])
+			l.buffer = l.buffer[l.maxLength:]
+			continue
+		}
+		if i < 0 {
+			break
+		}
+
+		l.handler(bytes.TrimRight(l.buffer[:i], "\r"))
+		l.buffer = l.buffer[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush calls the handler for the remaining (incomplete) line
+func (l *lineWriter) Flush() {
+	if len(l.buffer) > 0 {
+		l.handler(l.buffer)
+		l.buffer = nil
+	}
+}
+
+const (
+	TruncateHead     = "head"
+	TruncateTail     = "tail"
+	TruncationMarker = "<TRUNCATED>"
+)
+
+// limitedBuffer stores at most limit bytes. Depending on the strategy the first (head) or the last (tail) bytes are kept.
+type limitedBuffer struct {
+	limit     int
+	strategy  string
+	buffer    []byte
+	truncated bool
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if l.limit <= 0 {
+		l.buffer = append(l.buffer, p...)
+		return len(p), nil
+	}
+
+	if l.strategy == TruncateTail {
+		l.buffer = append(l.buffer, p...)
+		if overflow := len(l.buffer) - l.limit; overflow > 0 {
+			l.buffer = append(l.buffer[:0], l.buffer[overflow:]...)
+			l.truncated = true
+		}
+	} else {
+		remaining := l.limit - len(l.buffer)
+		if remaining < len(p) {
+			l.truncated = true
+		} else {
+			remaining = len(p)
+		}
+		l.buffer = append(l.buffer, p[:remaining]...)
+	}
+
+	//we pretend that all bytes are written - otherwise the process' output would be blocked
+	return len(p), nil
+}
+
+// Bytes returns the content of the buffer (including the truncation marker if the content was truncated)
+func (l *limitedBuffer) Bytes() []byte {
+	if !l.truncated {
+		return l.buffer
+	}
+	if l.strategy == TruncateTail {
+		return append([]byte(TruncationMarker+"\n"), l.buffer...)
+	}
+	return append(append([]byte{}, l.buffer...), []byte("\n"+TruncationMarker)...)
+}
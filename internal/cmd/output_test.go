@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLimitedBuffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		strategy string
+		writes   []string
+		expected string
+	}{
+		{name: "unlimited", writes: []string{"hello ", "world"}, expected: "hello world"},
+		{name: "below limit", limit: 11, writes: []string{"hello ", "world"}, expected: "hello world"},
+		{name: "head", limit: 8, strategy: TruncateHead, writes: []string{"hello ", "world", "!"}, expected: "hello wo\n<TRUNCATED>"},
+		{name: "default is head", limit: 5, writes: []string{"hello world"}, expected: "hello\n<TRUNCATED>"},
+		{name: "tail", limit: 8, strategy: TruncateTail, writes: []string{"hello ", "world", "!"}, expected: "<TRUNCATED>\no world!"},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestLimitedBuffer_"+tt.name, func(t *testing.T) {
+			buffer := &limitedBuffer{limit: tt.limit, strategy: tt.strategy}
+			for _, write := range tt.writes {
+				n, err := buffer.Write([]byte(write))
+				assert.NoError(t, err)
+				assert.Equal(t, len(write), n)
+			}
+			assert.Equal(t, tt.expected, string(buffer.Bytes()))
+			if tt.limit > 0 {
+				assert.True(t, len(buffer.buffer) <= tt.limit)
+			}
+		})
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	writer := &lineWriter{
+		handler: func(line []byte) {
+			lines = append(lines, string(line))
+		},
+		maxLength: 5,
+	}
+
+	writer.Write([]byte("one\r\ntw"))
+	writer.Write([]byte("o\nthree"))
+	writer.Write([]byte("four\nfi"))
+	writer.Flush()
+
+	assert.Equal(t, []string{"one", "two", "three", "four", "fi"}, lines)
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	PriorityLow  = 0
+	PriorityHigh = 1
+)
+
+// Metrics contains the statistics of the executor's worker pool
+type Metrics struct {
+	Running     int   `json:"running"`
+	Waiting     int   `json:"waiting"`
+	Executions  int64 `json:"executions"`
+	WaitTimeMs  int64 `json:"wait_time_ms"`
+	MaxWaitMs   int64 `json:"max_wait_time_ms"`
+	TotalWaitMs int64 `json:"total_wait_time_ms"`
+}
+
+// workerPool limits the number of concurrent executions (global and per group). Waiting executions with a higher
+// priority will be started first. Executions with the same priority will be started in order of their arrival.
+type workerPool struct {
+	lock sync.Mutex
+
+	maxConcurrency int            //0 means unlimited
+	groupLimits    map[string]int //a missing group means unlimited
+
+	running      int
+	groupRunning map[string]int
+	waiting      []*poolWaiter
+
+	executions int64
+	lastWait   time.Duration
+	maxWait    time.Duration
+	totalWait  time.Duration
+}
+
+type poolWaiter struct {
+	group    string
+	priority int
+	ready    chan struct{}
+}
+
+func newWorkerPool() *workerPool {
+	return &workerPool{
+		groupLimits:  map[string]int{},
+		groupRunning: map[string]int{},
+	}
+}
+
+func (p *workerPool) setLimits(maxConcurrency int, groupLimits map[string]int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.maxConcurrency = maxConcurrency
+	p.groupLimits = map[string]int{}
+	for group, limit := range groupLimits {
+		p.groupLimits[group] = limit
+	}
+
+	//the new limits could be higher than the old ones
+	p.dispatch()
+}
+
+// acquire waits until the execution is allowed to run. The returned function must be called after the execution.
+func (p *workerPool) acquire(ctx context.Context, group string, priority int) (func(), error) {
+	start := time.Now()
+	waiter := &poolWaiter{
+		group:    group,
+		priority: priority,
+		ready:    make(chan struct{}),
+	}
+
+	p.lock.Lock()
+	//the waiting list is sorted by priority (stable -> first come first serve for the same priority)
+	i := sort.Search(len(p.waiting), func(i int) bool {
+		return p.waiting[i].priority < priority
+	})
+	p.waiting = append(p.waiting, nil)
+	copy(p.waiting[i+1:], p.waiting[i:])
+	p.waiting[i] = waiter
+	p.dispatch()
+	p.lock.Unlock()
+
+	select {
+	case <-waiter.ready:
+	case <-ctx.Done():
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		select {
+		case <-waiter.ready:
+			//the waiter was started in the meantime -> give back the slot
+			p.release(waiter.group)
+		default:
+			p.remove(waiter)
+		}
+		return nil, ctx.Err()
+	}
+
+	p.lock.Lock()
+	wait := time.Since(start)
+	p.executions++
+	p.lastWait = wait
+	p.totalWait += wait
+	if wait > p.maxWait {
+		p.maxWait = wait
+	}
+	p.lock.Unlock()
+
+	return func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		p.release(group)
+	}, nil
+}
+
+// dispatch starts as many waiters as possible. The lock must be held by the caller!
+func (p *workerPool) dispatch() {
+	for i := 0; i < len(p.waiting); {
+		if p.maxConcurrency > 0 && p.running >= p.maxConcurrency {
+			//no more free slots
+			return
+		}
+
+		waiter := p.waiting[i]
+		if limit, exists := p.groupLimits[waiter.group]; exists && p.groupRunning[waiter.group] >= limit {
+			//the group is full but other groups could be started
+			i++
+			continue
+		}
+
+		p.running++
+		p.groupRunning[waiter.group]++
+		p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+		close(waiter.ready)
+	}
+}
+
+// release gives back the slot of a finished execution. The lock must be held by the caller!
+func (p *workerPool) release(group string) {
+	p.running--
+	p.groupRunning[group]--
+	if p.groupRunning[group] <= 0 {
+		delete(p.groupRunning, group)
+	}
+
+	p.dispatch()
+}
+
+func (p *workerPool) remove(waiter *poolWaiter) {
+	for i, w := range p.waiting {
+		if w == waiter {
+			p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *workerPool) metrics() Metrics {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return Metrics{
+		Running:     p.running,
+		Waiting:     len(p.waiting),
+		Executions:  p.executions,
+		WaitTimeMs:  p.lastWait.Milliseconds(),
+		MaxWaitMs:   p.maxWait.Milliseconds(),
+		TotalWaitMs: p.totalWait.Milliseconds(),
+	}
+}
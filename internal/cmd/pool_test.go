@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool_MaxConcurrency(t *testing.T) {
+	pool := newWorkerPool()
+	pool.setLimits(1, nil)
+
+	release, err := pool.acquire(context.Background(), "", PriorityLow)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = pool.acquire(ctx, "", PriorityLow)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	release()
+	release, err = pool.acquire(context.Background(), "", PriorityLow)
+	assert.NoError(t, err)
+	release()
+
+	metrics := pool.metrics()
+	assert.Equal(t, 0, metrics.Running)
+	assert.Equal(t, 0, metrics.Waiting)
+	assert.Equal(t, int64(2), metrics.Executions)
+}
+
+func TestWorkerPool_GroupLimit(t *testing.T) {
+	pool := newWorkerPool()
+	pool.setLimits(0, map[string]int{"heavy": 1})
+
+	release, err := pool.acquire(context.Background(), "heavy", PriorityLow)
+	assert.NoError(t, err)
+	defer release()
+
+	//other groups are not affected
+	other, err := pool.acquire(context.Background(), "", PriorityLow)
+	assert.NoError(t, err)
+	defer other()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = pool.acquire(ctx, "heavy", PriorityLow)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, pool.metrics().Waiting)
+}
+
+func TestWorkerPool_Priority(t *testing.T) {
+	pool := newWorkerPool()
+	pool.setLimits(1, nil)
+
+	release, err := pool.acquire(context.Background(), "", PriorityLow)
+	assert.NoError(t, err)
+
+	lock := sync.Mutex{}
+	var order []string
+	wg := sync.WaitGroup{}
+	start := func(name string, priority int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r, err := pool.acquire(context.Background(), "", priority)
+			assert.NoError(t, err)
+
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+			r()
+		}()
+
+		//wait until the execution is waiting
+		assert.Eventually(t, func() bool {
+			return pool.metrics().Waiting == len(name)
+		}, time.Second, time.Millisecond)
+	}
+	start("l", PriorityLow)
+	start("ll", PriorityLow)
+	start("hhh", PriorityHigh)
+
+	release()
+	wg.Wait()
+
+	assert.Equal(t, []string{"hhh", "l", "ll"}, order)
+}
+
+func TestCommandExecutor_Limits(t *testing.T) {
+	executor := NewCommandExecutor()
+	executor.SetLimits(1, nil)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := executor.ExecuteWithContext(Execution{Name: "sleep", Arguments: []string{"0.2"}}, context.Background())
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	//the second execution had to wait for the first one
+	metrics := executor.Metrics()
+	assert.Equal(t, int64(2), metrics.Executions)
+	assert.True(t, metrics.MaxWaitMs >= 150, "max wait: %d", metrics.MaxWaitMs)
+}
+
+func TestCommandExecutor_TimeoutWhileWaiting(t *testing.T) {
+	executor := NewCommandExecutor()
+	executor.SetLimits(1, nil)
+
+	go executor.ExecuteWithContext(Execution{Name: "sleep", Arguments: []string{"0.5"}}, context.Background())
+	assert.Eventually(t, func() bool {
+		return executor.Metrics().Running == 1
+	}, time.Second, time.Millisecond)
+
+	//the timeout includes the waiting time and the execution will never be started
+	started := false
+	start := time.Now()
+	_, err := executor.ExecuteWithContext(Execution{
+		Name:         "true",
+		Timeout:      100 * time.Millisecond,
+		StartHandler: func() { started = true },
+	}, context.Background())
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.False(t, started)
+	assert.True(t, time.Since(start) < 400*time.Millisecond, "duration: %s", time.Since(start))
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// the umask is a process wide setting -> while a process with its own umask is started, no other process may be
+// started (otherwise it would inherit the wrong umask)
+var umaskLock sync.RWMutex
+
+func prepareProcess(command *exec.Cmd) {
+	//run the command in its own process group so that we are able to signal all of its children too
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func applyCredential(command *exec.Cmd, cred *credential) error {
+	command.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    cred.uid,
+		Gid:    cred.gid,
+		Groups: cred.groups,
+	}
+	return nil
+}
+
+func startProcess(command *exec.Cmd, umask *int) error {
+	if umask == nil {
+		umaskLock.RLock()
+		defer umaskLock.RUnlock()
+
+		return command.Start()
+	}
+
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+
+	//the child process will inherit our umask
+	oldMask := syscall.Umask(*umask)
+	defer syscall.Umask(oldMask)
+
+	return command.Start()
+}
+
+func terminateProcess(command *exec.Cmd) error {
+	return syscall.Kill(-command.Process.Pid, syscall.SIGTERM)
+}
+
+func killProcess(command *exec.Cmd) error {
+	return syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+}
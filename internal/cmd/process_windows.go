@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func prepareProcess(command *exec.Cmd) {
+	//nothing to do
+}
+
+func applyCredential(command *exec.Cmd, cred *credential) error {
+	return errors.New("running commands as different user is not supported on windows")
+}
+
+func startProcess(command *exec.Cmd, umask *int) error {
+	//there is no umask on windows
+	return command.Start()
+}
+
+func terminateProcess(command *exec.Cmd) error {
+	//there are no signals on windows -> kill immediately
+	return command.Process.Kill()
+}
+
+func killProcess(command *exec.Cmd) error {
+	return command.Process.Kill()
+}
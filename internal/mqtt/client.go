@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"time"
+)
+
+const (
+	ProtocolVersion3 = 3
+	ProtocolVersion5 = 5
+)
+
+// Message is an incoming mqtt message. The properties are only available with MQTT 5.
+type Message struct {
+	Topic           string
+	Payload         []byte
+	ResponseTopic   string
+	CorrelationData []byte
+	UserProperties  map[string]string
+}
+
+// MessageHandler will be called for each incoming message of a subscription
+type MessageHandler func(message Message)
+
+// PublishProperties contains the MQTT 5 properties of an outgoing message. They will be ignored for MQTT 3.1.1.
+type PublishProperties struct {
+	CorrelationData []byte
+	UserProperties  map[string]string
+	MessageExpiry   time.Duration
+}
+
+// Token can be used to wait for the completion of an asynchronous action
+type Token interface {
+	Wait() bool
+	Error() error
+}
+
+// Client is the abstraction of the mqtt protocol version (3.1.1 or 5) which is used for the broker connection
+type Client interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) Token
+	PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties PublishProperties) Token
+	Subscribe(topic string, qos byte, handler MessageHandler) Token
+	Unsubscribe(topics ...string) Token
+	Disconnect(timeout time.Duration)
+}
+
+type clientV3 struct {
+	client MQTT.Client
+}
+
+// NewClientV3 wraps the given MQTT 3.1.1 client
+func NewClientV3(client MQTT.Client) Client {
+	return &clientV3{client: client}
+}
+
+func (c *clientV3) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
+	return c.client.Publish(topic, qos, retained, payload)
+}
+
+func (c *clientV3) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, _ PublishProperties) Token {
+	//MQTT 3.1.1 does not support any properties
+	return c.client.Publish(topic, qos, retained, payload)
+}
+
+func (c *clientV3) Subscribe(topic string, qos byte, handler MessageHandler) Token {
+	return c.client.Subscribe(topic, qos, func(_ MQTT.Client, message MQTT.Message) {
+		handler(Message{
+			Topic:   message.Topic(),
+			Payload: message.Payload(),
+		})
+	})
+}
+
+func (c *clientV3) Unsubscribe(topics ...string) Token {
+	return c.client.Unsubscribe(topics...)
+}
+
+func (c *clientV3) Disconnect(timeout time.Duration) {
+	c.client.Disconnect(uint(timeout / time.Millisecond))
+}
+
+// payloadBytes converts the payload into bytes (the same payload types as the MQTT 3.1.1 client are supported)
+func payloadBytes(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case string:
+		return []byte(p), nil
+	case []byte:
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unknown payload type: %T", payload)
+	}
+}
@@ -0,0 +1,198 @@
+package mqtt
+
+import (
+	"context"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"go.uber.org/zap"
+	"time"
+)
+
+// actionTimeout is the maximum time to wait for the broker's acknowledgement of an action (publish, subscribe, ...)
+const actionTimeout = 10 * time.Second
+
+type clientV5 struct {
+	connection *autopaho.ConnectionManager
+	router     paho.Router
+	actions    chan func()
+}
+
+type token struct {
+	done chan struct{}
+	err  error
+}
+
+func newToken() *token {
+	return &token{done: make(chan struct{})}
+}
+
+func (t *token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *token) Error() error {
+	<-t.done
+	return t.err
+}
+
+func (t *token) complete(err error) {
+	t.err = err
+	close(t.done)
+}
+
+// NewClientV5 wraps the given MQTT 5 connection. The router must be the same which is used by the connection.
+// All actions are executed asynchronously but in the same order as they are called (same as the MQTT 3.1.1 client).
+func NewClientV5(connection *autopaho.ConnectionManager, router paho.Router) Client {
+	c := &clientV5{
+		connection: connection,
+		router:     router,
+		actions:    make(chan func(), 1024),
+	}
+	go c.run()
+
+	return c
+}
+
+func (c *clientV5) run() {
+	for action := range c.actions {
+		action()
+	}
+}
+
+func (c *clientV5) enqueue(action func() error) *token {
+	t := newToken()
+
+	select {
+	case c.actions <- func() { t.complete(action()) }:
+	case <-c.connection.Done():
+		t.complete(autopaho.ConnectionDownError)
+	}
+
+	return t
+}
+
+func (c *clientV5) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
+	return c.PublishWithProperties(topic, qos, retained, payload, PublishProperties{})
+}
+
+func (c *clientV5) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties PublishProperties) Token {
+	content, err := payloadBytes(payload)
+	if err != nil {
+		t := newToken()
+		t.complete(err)
+		return t
+	}
+
+	publish := &paho.Publish{
+		QoS:     qos,
+		Retain:  retained,
+		Topic:   topic,
+		Payload: content,
+		Properties: &paho.PublishProperties{
+			CorrelationData: properties.CorrelationData,
+			User:            toUserProperties(properties.UserProperties),
+		},
+	}
+	if properties.MessageExpiry > 0 {
+		expiry := messageExpiry(properties.MessageExpiry)
+		publish.Properties.MessageExpiry = &expiry
+	}
+
+	return c.enqueue(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+		defer cancel()
+
+		_, err := c.connection.Publish(ctx, publish)
+		if err != nil {
+			zap.L().Warn("Could not publish message.", zap.String("topic", topic), zap.Error(err))
+		}
+		return err
+	})
+}
+
+func (c *clientV5) Subscribe(topic string, qos byte, handler MessageHandler) Token {
+	//a new subscription replaces the old one (same as the MQTT 3.1.1 client)
+	c.router.UnregisterHandler(topic)
+	c.router.RegisterHandler(topic, func(publish *paho.Publish) {
+		message := Message{
+			Topic:   publish.Topic,
+			Payload: publish.Payload,
+		}
+		if publish.Properties != nil {
+			message.ResponseTopic = publish.Properties.ResponseTopic
+			message.CorrelationData = publish.Properties.CorrelationData
+			message.UserProperties = fromUserProperties(publish.Properties.User)
+		}
+
+		handler(message)
+	})
+
+	return c.enqueue(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+		defer cancel()
+
+		_, err := c.connection.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: map[string]paho.SubscribeOptions{
+				topic: {QoS: qos},
+			},
+		})
+		if err != nil {
+			zap.L().Warn("Could not subscribe topic.", zap.String("topic", topic), zap.Error(err))
+		}
+		return err
+	})
+}
+
+func (c *clientV5) Unsubscribe(topics ...string) Token {
+	for _, topic := range topics {
+		c.router.UnregisterHandler(topic)
+	}
+
+	return c.enqueue(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+		defer cancel()
+
+		_, err := c.connection.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+func (c *clientV5) Disconnect(timeout time.Duration) {
+	//wait until all pending actions are done
+	select {
+	case <-c.enqueue(func() error { return nil }).done:
+	case <-time.After(timeout):
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c.connection.Disconnect(ctx)
+}
+
+// messageExpiry converts the given expiry into seconds. Fractions will be rounded up: an expiry of 0 seconds would
+// expire the message immediately.
+func messageExpiry(expiry time.Duration) uint32 {
+	return uint32((expiry + time.Second - 1) / time.Second)
+}
+
+func toUserProperties(properties map[string]string) paho.UserProperties {
+	var result paho.UserProperties
+	for key, value := range properties {
+		result.Add(key, value)
+	}
+	return result
+}
+
+func fromUserProperties(properties paho.UserProperties) map[string]string {
+	if len(properties) == 0 {
+		return nil
+	}
+
+	result := map[string]string{}
+	for _, property := range properties {
+		result[property.Key] = property.Value
+	}
+	return result
+}
@@ -0,0 +1,47 @@
+package mqtt
+
+import (
+	"errors"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPayloadBytes(t *testing.T) {
+	content, err := payloadBytes("text")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("text"), content)
+
+	content, err = payloadBytes([]byte("bytes"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bytes"), content)
+
+	_, err = payloadBytes(13)
+	assert.EqualError(t, err, "unknown payload type: int")
+}
+
+func TestUserProperties(t *testing.T) {
+	properties := toUserProperties(map[string]string{"key": "value"})
+	assert.Equal(t, paho.UserProperties{{Key: "key", Value: "value"}}, properties)
+	assert.Equal(t, map[string]string{"key": "value"}, fromUserProperties(properties))
+
+	assert.Nil(t, toUserProperties(nil))
+	assert.Nil(t, fromUserProperties(nil))
+}
+
+func TestMessageExpiry(t *testing.T) {
+	assert.Equal(t, uint32(1), messageExpiry(time.Millisecond))
+	assert.Equal(t, uint32(1), messageExpiry(500*time.Millisecond))
+	assert.Equal(t, uint32(1), messageExpiry(time.Second))
+	assert.Equal(t, uint32(2), messageExpiry(1500*time.Millisecond))
+	assert.Equal(t, uint32(300), messageExpiry(5*time.Minute))
+}
+
+func TestToken(t *testing.T) {
+	tok := newToken()
+	go tok.complete(errors.New("failed"))
+
+	assert.True(t, tok.Wait())
+	assert.EqualError(t, tok.Error(), "failed")
+}
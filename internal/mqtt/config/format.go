@@ -0,0 +1,117 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	FormatAuto = "auto"
+	FormatJson = "json"
+	FormatYaml = "yaml"
+	FormatToml = "toml"
+)
+
+// DetectFormat determines the configuration format by the file extension (json is the fallback)
+func DetectFormat(configFilePath string) string {
+	switch strings.ToLower(filepath.Ext(configFilePath)) {
+	case ".yaml", ".yml":
+		return FormatYaml
+	case ".toml":
+		return FormatToml
+	default:
+		return FormatJson
+	}
+}
+
+// toJson converts the given content into json. So all formats can be decoded (and validated) in the same way.
+func toJson(content []byte, format string) ([]byte, error) {
+	var data interface{}
+
+	switch format {
+	case FormatJson:
+		return stripJsonComments(content), nil
+	case FormatYaml:
+		if len(bytes.TrimSpace(content)) == 0 {
+			return nil, nil
+		}
+		if err := yaml.Unmarshal(content, &data); err != nil {
+			return nil, err
+		}
+	case FormatToml:
+		if len(bytes.TrimSpace(content)) == 0 {
+			return nil, nil
+		}
+		tomlData := map[string]interface{}{}
+		if _, err := toml.Decode(string(content), &tomlData); err != nil {
+			return nil, err
+		}
+		data = tomlData
+	default:
+		return nil, fmt.Errorf("unknown format: %s", format)
+	}
+
+	return json.Marshal(data)
+}
+
+// stripJsonComments replaces all comments (// and /* */) outside of strings with whitespaces. Trailing commas
+// will be replaced too. The positions of all other characters are kept so that error offsets are still valid.
+func stripJsonComments(content []byte) []byte {
+	result := append([]byte{}, content...)
+	inString, escaped := false, false
+	lastComma := -1
+
+	for i := 0; i < len(result); i++ {
+		c := result[i]
+
+		if inString {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+			lastComma = -1
+		case c == '/' && i+1 < len(result) && result[i+1] == '/':
+			for ; i < len(result) && result[i] != '\n'; i++ {
+				result[i] = ' '
+			}
+		case c == '/' && i+1 < len(result) && result[i+1] == '*':
+			for ; i < len(result) && !(result[i] == '*' && i+1 < len(result) && result[i+1] == '/'); i++ {
+				if result[i] != '\n' {
+					result[i] = ' '
+				}
+			}
+			if i < len(result) {
+				result[i] = ' '
+				result[i+1] = ' '
+				i++
+			}
+		case c == ',':
+			lastComma = i
+		case c == '}' || c == ']':
+			if lastComma >= 0 {
+				//trailing comma
+				result[lastComma] = ' '
+			}
+			lastComma = -1
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			lastComma = -1
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+type Regexp struct {
+	*regexp.Regexp
+}
+
+func (r *Regexp) UnmarshalJSON(b []byte) error {
+	var expression string
+	if err := json.Unmarshal(b, &expression); err != nil {
+		return fmt.Errorf("invalid regex: %w", err)
+	}
+
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		return fmt.Errorf("invalid regex: %w", err)
+	}
+
+	r.Regexp = compiled
+	return nil
+}
+
+func (r Regexp) MarshalJSON() ([]byte, error) {
+	if r.Regexp == nil {
+		return json.Marshal("")
+	}
+	return json.Marshal(r.String())
+}
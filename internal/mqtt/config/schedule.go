@@ -0,0 +1,38 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/robfig/cron/v3"
+)
+
+// the seconds field is optional; a timezone can be defined with the prefix "CRON_TZ=Europe/Berlin"
+var scheduleParser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
+type Schedule struct {
+	cron.Schedule
+
+	Expression string
+}
+
+func (s *Schedule) UnmarshalJSON(b []byte) error {
+	var expression string
+	if err := json.Unmarshal(b, &expression); err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+
+	schedule, err := scheduleParser.Parse(expression)
+	if err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+
+	s.Schedule = schedule
+	s.Expression = expression
+	return nil
+}
+
+func (s Schedule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Expression)
+}
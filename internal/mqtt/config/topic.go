@@ -1,9 +1,12 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/rainu/mqtt-executor/internal/cmd"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"strings"
@@ -11,12 +14,38 @@ import (
 )
 
 type TopicConfigurations struct {
+	Connection   *Connection   `json:"connection,omitempty"`
 	Availability *Availability `json:"availability,omitempty"`
+	Limits       *Limits       `json:"limits,omitempty"`
 	Trigger      []Trigger     `json:"trigger"`
 	Sensor       []Sensor      `json:"sensor"`
 	MultiSensor  []MultiSensor `json:"multi_sensor"`
 }
 
+// Connection contains the settings which can also be set by flag or environment variable. The names are the same
+// as the flag names (with underscores instead of dashes).
+type Connection struct {
+	Broker              string `json:"broker,omitempty"`
+	ProtocolVersion     *int   `json:"protocol_version,omitempty"`
+	SubscribeQOS        *int   `json:"sub_qos,omitempty"`
+	PublishQOS          *int   `json:"pub_qos,omitempty"`
+	Username            string `json:"user,omitempty"`
+	Password            string `json:"password,omitempty"`
+	ClientId            string `json:"client_id,omitempty"`
+	DeviceName          string `json:"device_name,omitempty"`
+	DeviceId            string `json:"device_id,omitempty"`
+	TLSCaFile           string `json:"tls_ca,omitempty"`
+	TLSCertFile         string `json:"tls_cert,omitempty"`
+	TLSKeyFile          string `json:"tls_key,omitempty"`
+	TLSServerName       string `json:"tls_server_name,omitempty"`
+	TLSInsecure         *bool  `json:"tls_insecure,omitempty"`
+	HomeassistantEnable *bool  `json:"home_assistant,omitempty"`
+	HomeassistantTopic  string `json:"ha_discovery_prefix,omitempty"`
+	HomeassistantStatus string `json:"ha_status_topic,omitempty"`
+	MaxOutputBytes      *int   `json:"max_output_bytes,omitempty"`
+	MessageExpiry       string `json:"message_expiry,omitempty"`
+}
+
 type Availability struct {
 	Topic   string              `json:"topic"`
 	Payload availabilityPayload `json:"payload"`
@@ -26,18 +55,183 @@ type availabilityPayload struct {
 	Unavailable string `json:"unavailable"`
 }
 
+// Limits restricts the number of concurrently running commands (over all triggers and sensors)
+type Limits struct {
+	//the maximum number of concurrently running commands (0 means unlimited)
+	MaxConcurrency int `json:"max_concurrency"`
+	//the maximum number of concurrently running commands per limit group (see Command.LimitGroup)
+	Groups  map[string]int `json:"groups"`
+	Metrics *Metrics       `json:"metrics,omitempty"`
+}
+
+// Metrics describes where and how often the metrics of the execution limits should be published
+type Metrics struct {
+	Topic    string   `json:"topic"`
+	Interval Interval `json:"interval"`
+}
+
+const DefaultMetricsInterval = Interval(time.Minute)
+
 type Trigger struct {
-	Name    string  `json:"name"`
-	Topic   string  `json:"topic"`
-	Icon    string  `json:"icon"`
-	Command Command `json:"command"`
+	Name    string          `json:"name"`
+	Topic   string          `json:"topic"`
+	Icon    string          `json:"icon"`
+	Command Command         `json:"command"`
+	Payload *TriggerPayload `json:"payload,omitempty"`
+	Result  *Result         `json:"result,omitempty"`
+	Stream  *Stream         `json:"stream,omitempty"`
+
+	Schedule    *Schedule    `json:"schedule,omitempty"`
+	Rpc         bool         `json:"rpc,omitempty"`
+	Concurrency *Concurrency `json:"concurrency,omitempty"`
+
+	//the prefix which the reply topics of the rpc envelopes must start with (optional)
+	RpcReplyPrefix string `json:"rpc_reply_prefix,omitempty"`
+
+	//the home assistant component of the trigger: switch (default), button, number, select or text
+	HaComponent string `json:"ha_component,omitempty"`
+	HaEntity
+}
+
+const (
+	HaComponentSwitch       = "switch"
+	HaComponentButton       = "button"
+	HaComponentNumber       = "number"
+	HaComponentSelect       = "select"
+	HaComponentText         = "text"
+	HaComponentSensor       = "sensor"
+	HaComponentBinarySensor = "binary_sensor"
+)
+
+const (
+	HaStateClassMeasurement     = "measurement"
+	HaStateClassTotal           = "total"
+	HaStateClassTotalIncreasing = "total_increasing"
+
+	HaEntityCategoryConfig     = "config"
+	HaEntityCategoryDiagnostic = "diagnostic"
+)
+
+// HaEntity contains the optional home assistant settings of an entity
+type HaEntity struct {
+	DeviceClass      string `json:"device_class,omitempty"`
+	StateClass       string `json:"state_class,omitempty"`
+	EntityCategory   string `json:"entity_category,omitempty"`
+	DisplayPrecision *int   `json:"suggested_display_precision,omitempty"`
+
+	//the sensor value will be unavailable after this time without a new value (default: a multiple of the interval)
+	ExpireAfter *Interval `json:"expire_after,omitempty"`
+}
+
+// HaBinary describes which sensor values mean on and off (only for the home assistant component binary_sensor)
+type HaBinary struct {
+	On  string `json:"on"`
+	Off string `json:"off"`
+}
+
+const (
+	PayloadFormatText = "text"
+	PayloadFormatJson = "json"
+
+	PayloadModeArguments = "arguments"
+	PayloadModeEnv       = "env"
+	PayloadModeStdin     = "stdin"
+
+	//the name of the (only) field of the text format
+	PayloadValueField = "value"
+
+	//the (case-insensitive) payloads which start and stop a trigger - they can never be an input
+	PayloadStart = "START"
+	PayloadStop  = "STOP"
+)
+
+type TriggerPayload struct {
+	Format string `json:"format"`
+	Mode   string `json:"mode"`
+
+	//the allowed fields of the payload (nil means that every payload is allowed). For the text format the only
+	//field is "value".
+	Schema map[string]PayloadField `json:"schema,omitempty"`
+}
+
+// PayloadField describes the allowed values of a payload field. All conditions must be fulfilled.
+type PayloadField struct {
+	Required bool     `json:"required"`
+	Enum     []string `json:"enum,omitempty"`
+	Regex    *Regexp  `json:"regex,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+
+	//the step size of the home assistant number entity (it is not validated)
+	Step *float64 `json:"step,omitempty"`
+}
+
+const (
+	ResultFormatRaw  = "raw"
+	ResultFormatJson = "json"
+)
+
+type Result struct {
+	Format    string `json:"format"`
+	SubTopics bool   `json:"sub_topics"`
+}
+
+type Stream struct {
+	Interval Interval `json:"interval"`
+}
+
+const (
+	ConcurrencySkip     = "skip"
+	ConcurrencyQueue    = "queue"
+	ConcurrencyReplace  = "replace"
+	ConcurrencyParallel = "parallel"
+
+	DefaultConcurrencyLimit = 10
+)
+
+// Concurrency describes what happens if a trigger is started while its command is still running
+type Concurrency struct {
+	Mode string `json:"mode"`
+	//the maximum number of queued executions (queue) or running executions (parallel)
+	Limit int `json:"limit"`
 }
 
 type GeneralSensor struct {
-	ResultTopic string   `json:"topic"`
-	Retained    bool     `json:"retained"`
-	Interval    Interval `json:"interval"`
-	Command     Command  `json:"command"`
+	ResultTopic string    `json:"topic"`
+	Retained    bool      `json:"retained"`
+	Interval    Interval  `json:"interval"`
+	Schedule    *Schedule `json:"schedule,omitempty"`
+	Command     Command   `json:"command"`
+	Result      *Result   `json:"result,omitempty"`
+
+	PublishMode   string    `json:"publish_mode"`
+	Deadband      *Deadband `json:"deadband,omitempty"`
+	ForceInterval Interval  `json:"force_interval"`
+
+	Parse *Parse `json:"parse,omitempty"`
+}
+
+// Parse describes how the command's output should be transformed before publishing. The steps are
+// applied in the following order: json_path, key, regex, number, scale and precision.
+type Parse struct {
+	JsonPath  string   `json:"json_path"`
+	Key       string   `json:"key"`
+	Separator string   `json:"separator"`
+	Regex     *Regexp  `json:"regex,omitempty"`
+	Number    bool     `json:"number"`
+	Scale     *float64 `json:"scale,omitempty"`
+	Precision *int     `json:"precision,omitempty"`
+}
+
+const (
+	PublishModeAlways   = "always"
+	PublishModeOnChange = "on_change"
+	PublishModeDeadband = "deadband"
+)
+
+type Deadband struct {
+	Absolute float64 `json:"absolute"`
+	Percent  float64 `json:"percent"`
 }
 
 type Sensor struct {
@@ -46,35 +240,79 @@ type Sensor struct {
 	Name string `json:"name"`
 	Unit string `json:"unit"`
 	Icon string `json:"icon"`
+
+	//the home assistant component of the sensor: sensor (default) or binary_sensor
+	HaComponent string    `json:"ha_component,omitempty"`
+	HaBinary    *HaBinary `json:"ha_binary,omitempty"`
+	HaEntity
 }
 
 type MultiSensor struct {
 	GeneralSensor
 
+	//if true, each value will be published to its own topic "<topic>/<name>"
+	FanOut bool               `json:"fan_out"`
 	Values []MultiSensorValue `json:"values"`
 }
 
 type MultiSensorValue struct {
 	Name     string `json:"name"`
 	Template string `json:"template"`
+	JsonPath string `json:"json_path"`
 	Unit     string `json:"unit"`
 	Icon     string `json:"icon"`
+
+	//the home assistant component of the value: sensor (default) or binary_sensor
+	HaComponent string    `json:"ha_component,omitempty"`
+	HaBinary    *HaBinary `json:"ha_binary,omitempty"`
+	HaEntity
+}
+
+// ValueTopic returns the topic for the given value (only used in fan out mode)
+func (m *MultiSensor) ValueTopic(value MultiSensorValue) string {
+	return fmt.Sprintf("%s/%s", m.ResultTopic, strings.Replace(value.Name, " ", "_", -1))
 }
 
 type Command struct {
-	Name      string   `json:"name"`
-	Arguments []string `json:"arguments"`
+	Name        string            `json:"name"`
+	Arguments   []string          `json:"arguments"`
+	Timeout     Interval          `json:"timeout"`
+	GracePeriod Interval          `json:"grace_period"`
+	Environment map[string]string `json:"env"`
+	InheritEnv  *bool             `json:"inherit_env"`
+	WorkingDir  string            `json:"working_dir"`
+	Umask       *Umask            `json:"umask"`
+	User        string            `json:"user"`
+	Group       string            `json:"group"`
+	Groups      []string          `json:"groups"`
+
+	MaxOutputBytes int    `json:"max_output_bytes"`
+	Truncate       string `json:"truncate"`
+	LimitGroup     string `json:"limit_group"`
 }
 
 func LoadTopicConfiguration(configFilePath, deviceId string) (TopicConfigurations, error) {
-	configFile, err := os.Open(configFilePath)
+	return LoadTopicConfigurationWithFormat(configFilePath, FormatAuto, deviceId)
+}
+
+func LoadTopicConfigurationWithFormat(configFilePath, format, deviceId string) (TopicConfigurations, error) {
+	content, err := ioutil.ReadFile(configFilePath)
 	if err != nil {
 		return TopicConfigurations{}, fmt.Errorf("error while opening topic configuration file: %w", err)
 	}
-	defer configFile.Close()
+
+	if format == FormatAuto || format == "" {
+		format = DetectFormat(configFilePath)
+	}
+
+	//all formats will be converted to json so that they are decoded in the same way
+	content, err = toJson(content, format)
+	if err != nil {
+		return TopicConfigurations{}, fmt.Errorf("could not read topic configuration file: %w", err)
+	}
 
 	var topicConfig TopicConfigurations
-	err = json.NewDecoder(configFile).Decode(&topicConfig)
+	err = json.NewDecoder(bytes.NewReader(content)).Decode(&topicConfig)
 	if err != nil {
 		return TopicConfigurations{}, fmt.Errorf("could not read topic configuration file: %w", err)
 	}
@@ -94,19 +332,64 @@ func LoadTopicConfiguration(configFilePath, deviceId string) (TopicConfiguration
 			topicConfig.Availability.Payload.Unavailable = "Offline"
 		}
 	}
+	if topicConfig.Limits != nil && topicConfig.Limits.Metrics != nil {
+		topicConfig.Limits.Metrics.Topic = strings.Replace(topicConfig.Limits.Metrics.Topic, "__DEVICE_ID__", deviceId, -1)
+		if topicConfig.Limits.Metrics.Interval == 0 {
+			topicConfig.Limits.Metrics.Interval = DefaultMetricsInterval
+		}
+	}
 	for i := range topicConfig.Trigger {
 		topicConfig.Trigger[i].Topic = strings.Replace(topicConfig.Trigger[i].Topic, "__DEVICE_ID__", deviceId, -1)
+
+		if topicConfig.Trigger[i].Payload != nil {
+			if topicConfig.Trigger[i].Payload.Format == "" {
+				topicConfig.Trigger[i].Payload.Format = defaultPayloadFormat(topicConfig.Trigger[i])
+			}
+			if topicConfig.Trigger[i].Payload.Mode == "" {
+				topicConfig.Trigger[i].Payload.Mode = PayloadModeArguments
+			}
+		}
+		setResultDefaults(topicConfig.Trigger[i].Result)
+		setConcurrencyDefaults(topicConfig.Trigger[i].Concurrency)
 	}
 	for i := range topicConfig.Sensor {
 		topicConfig.Sensor[i].ResultTopic = strings.Replace(topicConfig.Sensor[i].ResultTopic, "__DEVICE_ID__", deviceId, -1)
+		setResultDefaults(topicConfig.Sensor[i].Result)
+		setParseDefaults(topicConfig.Sensor[i].Parse)
 	}
 	for i := range topicConfig.MultiSensor {
 		topicConfig.MultiSensor[i].ResultTopic = strings.Replace(topicConfig.MultiSensor[i].ResultTopic, "__DEVICE_ID__", deviceId, -1)
+		setResultDefaults(topicConfig.MultiSensor[i].Result)
+		setParseDefaults(topicConfig.MultiSensor[i].Parse)
 	}
 
 	return topicConfig, nil
 }
 
+func setResultDefaults(result *Result) {
+	if result != nil && result.Format == "" {
+		result.Format = ResultFormatRaw
+	}
+}
+
+func setConcurrencyDefaults(concurrency *Concurrency) {
+	if concurrency == nil {
+		return
+	}
+	if concurrency.Mode == "" {
+		concurrency.Mode = ConcurrencySkip
+	}
+	if concurrency.Limit == 0 && (concurrency.Mode == ConcurrencyQueue || concurrency.Mode == ConcurrencyParallel) {
+		concurrency.Limit = DefaultConcurrencyLimit
+	}
+}
+
+func setParseDefaults(parse *Parse) {
+	if parse != nil && parse.Key != "" && parse.Separator == "" {
+		parse.Separator = "="
+	}
+}
+
 func (t *TopicConfigurations) Sensors() []GeneralSensor {
 	sensors := make([]GeneralSensor, 0, len(t.Sensor)+len(t.MultiSensor))
 	for _, sensor := range t.Sensor {
@@ -120,16 +403,22 @@ func (t *TopicConfigurations) Sensors() []GeneralSensor {
 
 func (t *TopicConfigurations) validate() error {
 	if t.Availability != nil {
-		if err := checkTopicName(t.Availability.Topic); err != nil {
+		if err := CheckTopicName(t.Availability.Topic); err != nil {
 			return fmt.Errorf("invalid availability topic: %w", err)
 		}
 	}
+	if err := validateLimits(t.Limits); err != nil {
+		return fmt.Errorf("invalid limits: %w", err)
+	}
 
 	sensorNames := map[string]bool{}
 	for i, sensor := range t.Sensor {
 		if err := validateSensor(sensor); err != nil {
 			return fmt.Errorf("invalid sensor (#%d): %w", i, err)
 		}
+		if err := validateLimitGroup(t.Limits, sensor.Command); err != nil {
+			return fmt.Errorf("invalid sensor (#%d): %w", i, err)
+		}
 
 		if _, exists := sensorNames[sensor.Name]; exists {
 			return fmt.Errorf("invalid sensor (#%d): sensor with this name already exists", i)
@@ -141,6 +430,9 @@ func (t *TopicConfigurations) validate() error {
 		if err := validateMultiSensor(sensor); err != nil {
 			return fmt.Errorf("invalid multi sensor (#%d): %w", i, err)
 		}
+		if err := validateLimitGroup(t.Limits, sensor.Command); err != nil {
+			return fmt.Errorf("invalid multi sensor (#%d): %w", i, err)
+		}
 
 		for _, multiSensorValue := range sensor.Values {
 			if _, exists := sensorNames[multiSensorValue.Name]; exists {
@@ -155,6 +447,9 @@ func (t *TopicConfigurations) validate() error {
 		if err := validateTrigger(trigger); err != nil {
 			return fmt.Errorf("invalid trigger (#%d): %w", i, err)
 		}
+		if err := validateLimitGroup(t.Limits, trigger.Command); err != nil {
+			return fmt.Errorf("invalid trigger (#%d): %w", i, err)
+		}
 
 		if _, exists := triggerNames[trigger.Name]; exists {
 			return fmt.Errorf("invalid trigger (#%d): trigger with this name already exists", i)
@@ -165,39 +460,154 @@ func (t *TopicConfigurations) validate() error {
 	return nil
 }
 
+func validateLimits(limits *Limits) error {
+	if limits == nil {
+		return nil
+	}
+	if limits.MaxConcurrency < 0 {
+		return errors.New("invalid max concurrency")
+	}
+	for group, limit := range limits.Groups {
+		if group == "" || limit <= 0 {
+			return fmt.Errorf("invalid group limit: %s", group)
+		}
+	}
+	if limits.Metrics != nil {
+		if err := CheckTopicName(limits.Metrics.Topic); err != nil {
+			return fmt.Errorf("invalid metrics topic: %w", err)
+		}
+		if limits.Metrics.Interval < 0 {
+			return errors.New("invalid metrics interval")
+		}
+	}
+	return nil
+}
+
+func validateLimitGroup(limits *Limits, command Command) error {
+	if command.LimitGroup == "" {
+		return nil
+	}
+	if limits != nil {
+		if _, exists := limits.Groups[command.LimitGroup]; exists {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown limit group: %s", command.LimitGroup)
+}
+
 func validateSensor(sensor Sensor) error {
 	if sensor.Name == "" {
 		return errors.New("name must not be empty")
 	}
-	if time.Duration(sensor.Interval).Nanoseconds() == 0 {
+	if sensor.Schedule == nil && time.Duration(sensor.Interval).Nanoseconds() == 0 {
 		return errors.New("invalid duration")
 	}
-	if err := checkTopicName(sensor.ResultTopic); err != nil {
+	if sensor.Schedule != nil && time.Duration(sensor.Interval).Nanoseconds() != 0 {
+		return errors.New("schedule and interval must not be combined")
+	}
+	if err := CheckTopicName(sensor.ResultTopic); err != nil {
 		return fmt.Errorf("invalid topic: %w", err)
 	}
-	if sensor.Command.Name == "" {
-		return errors.New("command name must not be empty")
+	if err := validateCommand(sensor.Command); err != nil {
+		return err
+	}
+	if err := validateResult(sensor.Result); err != nil {
+		return err
+	}
+	if err := validatePublishMode(sensor.GeneralSensor); err != nil {
+		return err
+	}
+	if err := validateParse(sensor.Parse); err != nil {
+		return err
+	}
+	if err := validateSensorComponent(sensor.HaComponent); err != nil {
+		return err
+	}
+	if err := validateSensorEntity(sensor.HaEntity); err != nil {
+		return err
+	}
+	return nil
+}
+
+func validateSensorEntity(entity HaEntity) error {
+	if entity.EntityCategory == HaEntityCategoryConfig {
+		//home assistant does not allow this category for sensors
+		return errors.New("invalid entity category")
+	}
+	return validateHaEntity(entity)
+}
+
+func validateHaEntity(entity HaEntity) error {
+	switch entity.StateClass {
+	case "", HaStateClassMeasurement, HaStateClassTotal, HaStateClassTotalIncreasing:
+	default:
+		return errors.New("invalid state class")
+	}
+	switch entity.EntityCategory {
+	case "", HaEntityCategoryConfig, HaEntityCategoryDiagnostic:
+	default:
+		return errors.New("invalid entity category")
+	}
+	if entity.DisplayPrecision != nil && *entity.DisplayPrecision < 0 {
+		return errors.New("invalid display precision")
+	}
+	if entity.ExpireAfter != nil && *entity.ExpireAfter < 0 {
+		return errors.New("invalid expire after")
 	}
 	return nil
 }
 
+func validateSensorComponent(component string) error {
+	switch component {
+	case "", HaComponentSensor, HaComponentBinarySensor:
+		return nil
+	default:
+		return errors.New("invalid home assistant component")
+	}
+}
+
 func validateMultiSensor(sensor MultiSensor) error {
 	for _, multiSensorValue := range sensor.Values {
 		if multiSensorValue.Name == "" {
 			return errors.New("name must not be empty")
 		}
-		if multiSensorValue.Template == "" {
+		if err := validateSensorComponent(multiSensorValue.HaComponent); err != nil {
+			return err
+		}
+		if err := validateSensorEntity(multiSensorValue.HaEntity); err != nil {
+			return err
+		}
+		if sensor.FanOut {
+			if multiSensorValue.JsonPath == "" {
+				return errors.New("json path must not be empty")
+			}
+			if err := CheckTopicName(sensor.ValueTopic(multiSensorValue)); err != nil {
+				return fmt.Errorf("invalid value topic: %w", err)
+			}
+		} else if multiSensorValue.Template == "" {
 			return errors.New("template must not be empty")
 		}
 	}
-	if time.Duration(sensor.Interval).Nanoseconds() == 0 {
+	if sensor.Schedule == nil && time.Duration(sensor.Interval).Nanoseconds() == 0 {
 		return errors.New("invalid duration")
 	}
-	if err := checkTopicName(sensor.ResultTopic); err != nil {
+	if sensor.Schedule != nil && time.Duration(sensor.Interval).Nanoseconds() != 0 {
+		return errors.New("schedule and interval must not be combined")
+	}
+	if err := CheckTopicName(sensor.ResultTopic); err != nil {
 		return fmt.Errorf("invalid topic: %w", err)
 	}
-	if sensor.Command.Name == "" {
-		return errors.New("command name must not be empty")
+	if err := validateCommand(sensor.Command); err != nil {
+		return err
+	}
+	if err := validateResult(sensor.Result); err != nil {
+		return err
+	}
+	if err := validatePublishMode(sensor.GeneralSensor); err != nil {
+		return err
+	}
+	if err := validateParse(sensor.Parse); err != nil {
+		return err
 	}
 	return nil
 }
@@ -206,18 +616,184 @@ func validateTrigger(trigger Trigger) error {
 	if trigger.Name == "" {
 		return errors.New("name must not be empty")
 	}
-	if err := checkTopicName(trigger.Topic); err != nil {
+	if err := CheckTopicName(trigger.Topic); err != nil {
 		return fmt.Errorf("invalid topic: %w", err)
 	}
-	if trigger.Command.Name == "" {
+	if err := validateCommand(trigger.Command); err != nil {
+		return err
+	}
+	if err := validateResult(trigger.Result); err != nil {
+		return err
+	}
+	if trigger.Stream != nil && trigger.Stream.Interval < 0 {
+		return errors.New("invalid stream interval")
+	}
+	if trigger.RpcReplyPrefix != "" {
+		if !trigger.Rpc {
+			return errors.New("rpc reply prefix requires rpc mode")
+		}
+		if err := CheckTopicName(trigger.RpcReplyPrefix); err != nil {
+			return fmt.Errorf("invalid rpc reply prefix: %w", err)
+		}
+	}
+	if trigger.Concurrency != nil {
+		switch trigger.Concurrency.Mode {
+		case "", ConcurrencySkip, ConcurrencyQueue, ConcurrencyReplace, ConcurrencyParallel:
+		default:
+			return errors.New("invalid concurrency mode")
+		}
+		if trigger.Concurrency.Limit < 0 {
+			return errors.New("invalid concurrency limit")
+		}
+	}
+	switch trigger.HaComponent {
+	case "", HaComponentSwitch, HaComponentButton:
+	case HaComponentNumber, HaComponentSelect, HaComponentText:
+		//the entity's value will be passed to the command
+		if trigger.Payload == nil {
+			return fmt.Errorf("home assistant component %s requires a payload", trigger.HaComponent)
+		}
+		if trigger.HaComponent == HaComponentSelect && len(trigger.Payload.Schema[PayloadValueField].Enum) == 0 {
+			return fmt.Errorf("home assistant component select requires the enum of the payload field %q", PayloadValueField)
+		}
+		if trigger.HaComponent != HaComponentSelect && trigger.Payload.Format != "" && trigger.Payload.Format != PayloadFormatJson {
+			//the free input of the entity could be START or STOP -> it must be wrapped into a json object
+			return fmt.Errorf("home assistant component %s requires the payload format json", trigger.HaComponent)
+		}
+	default:
+		return errors.New("invalid home assistant component")
+	}
+	if err := validateHaEntity(trigger.HaEntity); err != nil {
+		return err
+	}
+	if trigger.Payload != nil {
+		switch trigger.Payload.Format {
+		case "", PayloadFormatText, PayloadFormatJson:
+		default:
+			return errors.New("invalid payload format")
+		}
+		switch trigger.Payload.Mode {
+		case "", PayloadModeArguments, PayloadModeEnv, PayloadModeStdin:
+		default:
+			return errors.New("invalid payload mode")
+		}
+		//the defaults are not applied yet -> the schema must be checked against the effective format
+		payload := *trigger.Payload
+		if payload.Format == "" {
+			payload.Format = defaultPayloadFormat(trigger)
+		}
+		if err := validatePayloadSchema(payload); err != nil {
+			return fmt.Errorf("invalid payload schema: %w", err)
+		}
+	}
+	return nil
+}
+
+// defaultPayloadFormat returns the payload format of the given trigger if it is not set. The home assistant entities
+// with free input (number and text) send their value as json object (see hassio.Client).
+func defaultPayloadFormat(trigger Trigger) string {
+	switch trigger.HaComponent {
+	case HaComponentNumber, HaComponentText:
+		return PayloadFormatJson
+	default:
+		return PayloadFormatText
+	}
+}
+
+func validatePayloadSchema(payload TriggerPayload) error {
+	for name, field := range payload.Schema {
+		if name == "" {
+			return errors.New("field name must not be empty")
+		}
+		if payload.Format != PayloadFormatJson && name != PayloadValueField {
+			return fmt.Errorf("only the field %q is available for the text format", PayloadValueField)
+		}
+		if field.Min != nil && field.Max != nil && *field.Min > *field.Max {
+			return fmt.Errorf("min is greater than max: %s", name)
+		}
+		for _, enum := range field.Enum {
+			//the text payload is the value itself -> it would be handled as START or STOP
+			if payload.Format != PayloadFormatJson && (strings.EqualFold(enum, PayloadStart) || strings.EqualFold(enum, PayloadStop)) {
+				return fmt.Errorf("enum value %s of field %s can not be distinguished from %s and %s", enum, name, PayloadStart, PayloadStop)
+			}
+		}
+	}
+	return nil
+}
+
+func validateCommand(command Command) error {
+	if command.Name == "" {
 		return errors.New("command name must not be empty")
 	}
+	if command.WorkingDir != "" {
+		if stat, err := os.Stat(command.WorkingDir); err != nil || !stat.IsDir() {
+			return errors.New("working directory does not exist")
+		}
+	}
+	if command.MaxOutputBytes < 0 {
+		return errors.New("invalid max output bytes")
+	}
+	switch command.Truncate {
+	case "", cmd.TruncateHead, cmd.TruncateTail:
+	default:
+		return errors.New("invalid truncate strategy")
+	}
+	if err := cmd.ValidateCredential(command.User, command.Group, command.Groups); err != nil {
+		return err
+	}
+	for name := range command.Environment {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("invalid environment variable name: %s", name)
+		}
+	}
+	return nil
+}
+
+func validateResult(result *Result) error {
+	if result == nil {
+		return nil
+	}
+	switch result.Format {
+	case "", ResultFormatRaw, ResultFormatJson:
+	default:
+		return errors.New("invalid result format")
+	}
+	return nil
+}
+
+func validatePublishMode(sensor GeneralSensor) error {
+	switch sensor.PublishMode {
+	case "", PublishModeAlways, PublishModeOnChange:
+	case PublishModeDeadband:
+		if sensor.Deadband == nil || (sensor.Deadband.Absolute <= 0 && sensor.Deadband.Percent <= 0) {
+			return errors.New("deadband must be defined")
+		}
+	default:
+		return errors.New("invalid publish mode")
+	}
+	if sensor.Deadband != nil && (sensor.Deadband.Absolute < 0 || sensor.Deadband.Percent < 0) {
+		return errors.New("invalid deadband")
+	}
+	if sensor.ForceInterval < 0 {
+		return errors.New("invalid force interval")
+	}
+	return nil
+}
+
+func validateParse(parse *Parse) error {
+	if parse == nil {
+		return nil
+	}
+	if parse.Precision != nil && *parse.Precision < 0 {
+		return errors.New("invalid precision")
+	}
 	return nil
 }
 
 var topicRegex = regexp.MustCompile(`^[a-zA-Z0-9_/]*$`)
 
-func checkTopicName(topic string) error {
+// CheckTopicName checks if the given topic is a valid topic name (wildcards are not allowed)
+func CheckTopicName(topic string) error {
 	if strings.Trim(topic, " ") == "" {
 		return errors.New("must not be empty")
 	}
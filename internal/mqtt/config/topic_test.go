@@ -1,10 +1,13 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
@@ -25,6 +28,28 @@ func TestLoadTopicConfiguration(t *testing.T) {
 			name:    "empty json",
 			content: "{}",
 		},
+		{
+			name: "Connection",
+			content: `{
+				"connection": {
+					"broker": "tcp://127.0.0.1:1883",
+					"sub_qos": 0,
+					"user": "user",
+					"password": "secret",
+					"device_id": "D3V1C3",
+					"home_assistant": true
+				}
+			}`, expectedResult: TopicConfigurations{
+				Connection: &Connection{
+					Broker:              "tcp://127.0.0.1:1883",
+					SubscribeQOS:        integer(0),
+					Username:            "user",
+					Password:            "secret",
+					DeviceId:            "D3V1C3",
+					HomeassistantEnable: boolean(true),
+				},
+			},
+		},
 		{
 			name: "Availability",
 			content: `{
@@ -72,6 +97,66 @@ func TestLoadTopicConfiguration(t *testing.T) {
 			content:       `{ "availability": { "topic": "" } }`,
 			expectedError: "invalid config: invalid availability topic: must not be empty",
 		},
+		{
+			name: "Limits",
+			content: `{
+				"limits": {
+					"max_concurrency": 4,
+					"groups": { "heavy": 1 },
+					"metrics": { "topic": "tele/__DEVICE_ID__/metrics" }
+				},
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup",
+						"limit_group": "heavy"
+					}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Limits: &Limits{
+					MaxConcurrency: 4,
+					Groups:         map[string]int{"heavy": 1},
+					Metrics: &Metrics{
+						Topic:    fmt.Sprintf("tele/%s/metrics", deviceId),
+						Interval: DefaultMetricsInterval,
+					},
+				},
+				Trigger: []Trigger{{
+					Name:  "Backup",
+					Topic: "cmnd/backup",
+					Command: Command{
+						Name:       "/usr/bin/backup",
+						LimitGroup: "heavy",
+					},
+				}},
+			},
+		},
+		{
+			name:          "Limits invalid group limit",
+			content:       `{ "limits": { "groups": { "heavy": 0 } } }`,
+			expectedError: "invalid config: invalid limits: invalid group limit: heavy",
+		},
+		{
+			name:          "Limits invalid metrics topic",
+			content:       `{ "limits": { "metrics": { "topic": "tele/#" } } }`,
+			expectedError: "invalid config: invalid limits: invalid metrics topic: invalid character",
+		},
+		{
+			name: "Limits unknown group",
+			content: `{
+				"sensor": [{
+					"name": "Free Memory",
+					"topic": "tele/memory",
+					"interval": "10s",
+					"command": {
+						"name": "/usr/bin/free",
+						"limit_group": "heavy"
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid sensor (#0): unknown limit group: heavy",
+		},
 		{
 			name: "Sensor",
 			content: `{
@@ -103,182 +188,361 @@ func TestLoadTopicConfiguration(t *testing.T) {
 			},
 		},
 		{
-			name: "Sensor missing interval",
+			name: "Sensor with schedule",
 			content: `{
 				"sensor": [{
 					"name": "My sweat sensor",
 					"topic": "tele/__DEVICE_ID__/status",
+					"schedule": "CRON_TZ=Europe/Berlin 30 0 6 * * *",
 					"command": {
 						"name": "/usr/bin/bash",
 						"arguments": ["echo"]
 					}
 				}]
-			}`,
-			expectedError: "invalid config: invalid sensor (#0): invalid duration",
+			}`, expectedResult: TopicConfigurations{
+				Sensor: []Sensor{{
+					GeneralSensor: GeneralSensor{
+						ResultTopic: fmt.Sprintf("tele/%s/status", deviceId),
+						Schedule:    schedule("CRON_TZ=Europe/Berlin 30 0 6 * * *"),
+						Command: Command{
+							Name:      "/usr/bin/bash",
+							Arguments: []string{"echo"},
+						},
+					},
+					Name: "My sweat sensor",
+				}},
+			},
 		},
 		{
-			name: "Sensor missing name",
+			name: "Sensor invalid schedule",
 			content: `{
 				"sensor": [{
+					"name": "My sweat sensor",
 					"topic": "tele/__DEVICE_ID__/status",
-					"interval": "13s",
+					"schedule": "every day",
 					"command": {
 						"name": "/usr/bin/bash",
 						"arguments": ["echo"]
 					}
 				}]
 			}`,
-			expectedError: "invalid config: invalid sensor (#0): name must not be empty",
+			expectedError: "could not read topic configuration file: invalid schedule: expected 5 to 6 fields, found 2: [every day]",
 		},
 		{
-			name: "Sensor invalid topic",
+			name: "Sensor with schedule and interval",
 			content: `{
 				"sensor": [{
 					"name": "My sweat sensor",
-					"topic": "tele/+/status",
-					"interval": "13s",
+					"topic": "tele/__DEVICE_ID__/status",
+					"schedule": "@daily",
+					"interval": "10s",
 					"command": {
 						"name": "/usr/bin/bash",
 						"arguments": ["echo"]
 					}
 				}]
 			}`,
-			expectedError: "invalid config: invalid sensor (#0): invalid topic: invalid character",
+			expectedError: "invalid config: invalid sensor (#0): schedule and interval must not be combined",
 		},
 		{
-			name: "Sensor empty topic",
+			name: "Sensor with deadband",
 			content: `{
 				"sensor": [{
 					"name": "My sweat sensor",
+					"topic": "tele/status",
 					"interval": "13s",
+					"publish_mode": "deadband",
+					"deadband": { "absolute": 0.5 },
+					"force_interval": "10m",
 					"command": {
-						"name": "/usr/bin/bash",
-						"arguments": ["echo"]
+						"name": "/usr/bin/bash"
+					}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Sensor: []Sensor{{
+					GeneralSensor: GeneralSensor{
+						ResultTopic:   "tele/status",
+						Interval:      *interval(13 * time.Second),
+						PublishMode:   PublishModeDeadband,
+						Deadband:      &Deadband{Absolute: 0.5},
+						ForceInterval: *interval(10 * time.Minute),
+						Command: Command{
+							Name: "/usr/bin/bash",
+						},
+					},
+					Name: "My sweat sensor",
+				}},
+			},
+		},
+		{
+			name: "Sensor deadband missing",
+			content: `{
+				"sensor": [{
+					"name": "My sweat sensor",
+					"topic": "tele/status",
+					"interval": "13s",
+					"publish_mode": "deadband",
+					"command": {
+						"name": "/usr/bin/bash"
 					}
 				}]
 			}`,
-			expectedError: "invalid config: invalid sensor (#0): invalid topic: must not be empty",
+			expectedError: "invalid config: invalid sensor (#0): deadband must be defined",
 		},
 		{
-			name: "Sensor empty command",
+			name: "Sensor binary",
+			content: `{
+				"sensor": [{
+					"name": "Door",
+					"topic": "tele/door",
+					"interval": "13s",
+					"ha_component": "binary_sensor",
+					"ha_binary": { "on": "open", "off": "closed" },
+					"command": {
+						"name": "/usr/bin/door"
+					}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Sensor: []Sensor{{
+					GeneralSensor: GeneralSensor{
+						ResultTopic: "tele/door",
+						Interval:    *interval(13 * time.Second),
+						Command: Command{
+							Name: "/usr/bin/door",
+						},
+					},
+					Name:        "Door",
+					HaComponent: HaComponentBinarySensor,
+					HaBinary:    &HaBinary{On: "open", Off: "closed"},
+				}},
+			},
+		},
+		{
+			name: "Sensor with home assistant entity",
+			content: `{
+				"sensor": [{
+					"name": "Power",
+					"topic": "tele/power",
+					"interval": "13s",
+					"device_class": "power",
+					"state_class": "measurement",
+					"entity_category": "diagnostic",
+					"suggested_display_precision": 1,
+					"expire_after": "5m",
+					"command": {
+						"name": "/usr/bin/power"
+					}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Sensor: []Sensor{{
+					GeneralSensor: GeneralSensor{
+						ResultTopic: "tele/power",
+						Interval:    *interval(13 * time.Second),
+						Command: Command{
+							Name: "/usr/bin/power",
+						},
+					},
+					Name: "Power",
+					HaEntity: HaEntity{
+						DeviceClass:      "power",
+						StateClass:       HaStateClassMeasurement,
+						EntityCategory:   HaEntityCategoryDiagnostic,
+						DisplayPrecision: integer(1),
+						ExpireAfter:      interval(5 * time.Minute),
+					},
+				}},
+			},
+		},
+		{
+			name: "Sensor invalid state class",
+			content: `{
+				"sensor": [{
+					"name": "Power",
+					"topic": "tele/power",
+					"interval": "13s",
+					"state_class": "sum",
+					"command": {
+						"name": "/usr/bin/power"
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid sensor (#0): invalid state class",
+		},
+		{
+			name: "Sensor invalid entity category",
+			content: `{
+				"sensor": [{
+					"name": "Power",
+					"topic": "tele/power",
+					"interval": "13s",
+					"entity_category": "config",
+					"command": {
+						"name": "/usr/bin/power"
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid sensor (#0): invalid entity category",
+		},
+		{
+			name: "Sensor invalid home assistant component",
+			content: `{
+				"sensor": [{
+					"name": "Door",
+					"topic": "tele/door",
+					"interval": "13s",
+					"ha_component": "switch",
+					"command": {
+						"name": "/usr/bin/door"
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid sensor (#0): invalid home assistant component",
+		},
+		{
+			name: "Sensor invalid publish mode",
 			content: `{
 				"sensor": [{
 					"name": "My sweat sensor",
 					"topic": "tele/status",
 					"interval": "13s",
+					"publish_mode": "never",
 					"command": {
-						"arguments": ["echo"]
+						"name": "/usr/bin/bash"
 					}
 				}]
 			}`,
-			expectedError: "invalid config: invalid sensor (#0): command name must not be empty",
+			expectedError: "invalid config: invalid sensor (#0): invalid publish mode",
 		},
 		{
-			name: "Sensor duplicate name",
+			name: "Sensor with parser",
 			content: `{
 				"sensor": [{
 					"name": "My sweat sensor",
 					"topic": "tele/status",
 					"interval": "13s",
+					"parse": {
+						"key": "MemFree",
+						"regex": "([0-9]+) kB",
+						"scale": 0.001,
+						"precision": 2
+					},
 					"command": {
-						"name": "/usr/bin/bash",
-						"arguments": ["echo"]
+						"name": "/usr/bin/bash"
 					}
-				},{
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Sensor: []Sensor{{
+					GeneralSensor: GeneralSensor{
+						ResultTopic: "tele/status",
+						Interval:    *interval(13 * time.Second),
+						Parse: &Parse{
+							Key:       "MemFree",
+							Separator: "=",
+							Regex:     &Regexp{regexp.MustCompile("([0-9]+) kB")},
+							Scale:     float(0.001),
+							Precision: integer(2),
+						},
+						Command: Command{
+							Name: "/usr/bin/bash",
+						},
+					},
+					Name: "My sweat sensor",
+				}},
+			},
+		},
+		{
+			name: "Sensor invalid regex",
+			content: `{
+				"sensor": [{
 					"name": "My sweat sensor",
 					"topic": "tele/status",
 					"interval": "13s",
+					"parse": { "regex": "([0-9]+" },
 					"command": {
-						"name": "/usr/bin/bash",
-						"arguments": ["echo"]
+						"name": "/usr/bin/bash"
 					}
 				}]
 			}`,
-			expectedError: "invalid config: invalid sensor (#1): sensor with this name already exists",
+			expectedError: "could not read topic configuration file: invalid regex: error parsing regexp: missing closing ): `([0-9]+`",
 		},
 		{
-			name: "Trigger",
+			name: "Sensor missing interval",
 			content: `{
-				"trigger": [{
+				"sensor": [{
 					"name": "My sweat sensor",
 					"topic": "tele/__DEVICE_ID__/status",
-					"icon": "hassio-icon",
 					"command": {
 						"name": "/usr/bin/bash",
 						"arguments": ["echo"]
 					}
 				}]
-			}`, expectedResult: TopicConfigurations{
-				Trigger: []Trigger{{
-					Name:  "My sweat sensor",
-					Topic: fmt.Sprintf("tele/%s/status", deviceId),
-					Icon:  "hassio-icon",
-					Command: Command{
-						Name:      "/usr/bin/bash",
-						Arguments: []string{"echo"},
-					},
-				}},
-			},
+			}`,
+			expectedError: "invalid config: invalid sensor (#0): invalid duration",
 		},
 		{
-			name: "Trigger missing name",
+			name: "Sensor missing name",
 			content: `{
-				"trigger": [{
+				"sensor": [{
 					"topic": "tele/__DEVICE_ID__/status",
+					"interval": "13s",
 					"command": {
 						"name": "/usr/bin/bash",
 						"arguments": ["echo"]
 					}
 				}]
 			}`,
-			expectedError: "invalid config: invalid trigger (#0): name must not be empty",
+			expectedError: "invalid config: invalid sensor (#0): name must not be empty",
 		},
 		{
-			name: "Trigger invalid topic",
+			name: "Sensor invalid topic",
 			content: `{
-				"trigger": [{
+				"sensor": [{
 					"name": "My sweat sensor",
 					"topic": "tele/+/status",
+					"interval": "13s",
 					"command": {
 						"name": "/usr/bin/bash",
 						"arguments": ["echo"]
 					}
 				}]
 			}`,
-			expectedError: "invalid config: invalid trigger (#0): invalid topic: invalid character",
+			expectedError: "invalid config: invalid sensor (#0): invalid topic: invalid character",
 		},
 		{
-			name: "Trigger empty topic",
+			name: "Sensor empty topic",
 			content: `{
-				"trigger": [{
+				"sensor": [{
 					"name": "My sweat sensor",
+					"interval": "13s",
 					"command": {
 						"name": "/usr/bin/bash",
 						"arguments": ["echo"]
 					}
 				}]
 			}`,
-			expectedError: "invalid config: invalid trigger (#0): invalid topic: must not be empty",
+			expectedError: "invalid config: invalid sensor (#0): invalid topic: must not be empty",
 		},
 		{
-			name: "Trigger empty command",
+			name: "Sensor empty command",
 			content: `{
-				"trigger": [{
+				"sensor": [{
 					"name": "My sweat sensor",
 					"topic": "tele/status",
+					"interval": "13s",
 					"command": {
 						"arguments": ["echo"]
 					}
 				}]
 			}`,
-			expectedError: "invalid config: invalid trigger (#0): command name must not be empty",
+			expectedError: "invalid config: invalid sensor (#0): command name must not be empty",
 		},
 		{
-			name: "Trigger duplicate name",
+			name: "Sensor duplicate name",
 			content: `{
-				"trigger": [{
+				"sensor": [{
 					"name": "My sweat sensor",
 					"topic": "tele/status",
+					"interval": "13s",
 					"command": {
 						"name": "/usr/bin/bash",
 						"arguments": ["echo"]
@@ -286,45 +550,1100 @@ func TestLoadTopicConfiguration(t *testing.T) {
 				},{
 					"name": "My sweat sensor",
 					"topic": "tele/status",
+					"interval": "13s",
 					"command": {
 						"name": "/usr/bin/bash",
 						"arguments": ["echo"]
 					}
 				}]
 			}`,
-			expectedError: "invalid config: invalid trigger (#1): trigger with this name already exists",
+			expectedError: "invalid config: invalid sensor (#1): sensor with this name already exists",
 		},
+		{
+			name: "MultiSensor fan out",
+			content: `{
+				"multi_sensor": [{
+					"topic": "tele/stats",
+					"interval": "13s",
+					"fan_out": true,
+					"command": {
+						"name": "/usr/bin/bash"
+					},
+					"values": [{
+						"name": "Free Memory",
+						"json_path": "mem.free"
+					}]
+				}]
+			}`, expectedResult: TopicConfigurations{
+				MultiSensor: []MultiSensor{{
+					GeneralSensor: GeneralSensor{
+						ResultTopic: "tele/stats",
+						Interval:    *interval(13 * time.Second),
+						Command: Command{
+							Name: "/usr/bin/bash",
+						},
+					},
+					FanOut: true,
+					Values: []MultiSensorValue{{
+						Name:     "Free Memory",
+						JsonPath: "mem.free",
+					}},
+				}},
+			},
+		},
+		{
+			name: "MultiSensor fan out missing json path",
+			content: `{
+				"multi_sensor": [{
+					"topic": "tele/stats",
+					"interval": "13s",
+					"fan_out": true,
+					"command": {
+						"name": "/usr/bin/bash"
+					},
+					"values": [{
+						"name": "Free Memory"
+					}]
+				}]
+			}`,
+			expectedError: "invalid config: invalid multi sensor (#0): json path must not be empty",
+		},
+		{
+			name: "MultiSensor fan out invalid value topic",
+			content: `{
+				"multi_sensor": [{
+					"topic": "tele/stats",
+					"interval": "13s",
+					"fan_out": true,
+					"command": {
+						"name": "/usr/bin/bash"
+					},
+					"values": [{
+						"name": "Free Memory (%)",
+						"json_path": "mem.free"
+					}]
+				}]
+			}`,
+			expectedError: "invalid config: invalid multi sensor (#0): invalid value topic: invalid character",
+		},
+		{
+			name: "Trigger",
+			content: `{
+				"trigger": [{
+					"name": "My sweat sensor",
+					"topic": "tele/__DEVICE_ID__/status",
+					"icon": "hassio-icon",
+					"command": {
+						"name": "/usr/bin/bash",
+						"arguments": ["echo"]
+					}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:  "My sweat sensor",
+					Topic: fmt.Sprintf("tele/%s/status", deviceId),
+					Icon:  "hassio-icon",
+					Command: Command{
+						Name:      "/usr/bin/bash",
+						Arguments: []string{"echo"},
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger with payload",
+			content: `{
+				"trigger": [{
+					"name": "Set volume",
+					"topic": "cmnd/volume",
+					"command": {
+						"name": "/usr/bin/amixer",
+						"arguments": ["set", "Master", "${value}%"]
+					},
+					"payload": {}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:  "Set volume",
+					Topic: "cmnd/volume",
+					Command: Command{
+						Name:      "/usr/bin/amixer",
+						Arguments: []string{"set", "Master", "${value}%"},
+					},
+					Payload: &TriggerPayload{
+						Format: PayloadFormatText,
+						Mode:   PayloadModeArguments,
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger invalid payload format",
+			content: `{
+				"trigger": [{
+					"name": "Set volume",
+					"topic": "cmnd/volume",
+					"command": {
+						"name": "/usr/bin/amixer"
+					},
+					"payload": { "format": "xml" }
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid payload format",
+		},
+		{
+			name: "Trigger with payload schema",
+			content: `{
+				"trigger": [{
+					"name": "Set volume",
+					"topic": "cmnd/volume",
+					"command": {
+						"name": "/usr/bin/amixer",
+						"arguments": ["set", "${channel}", "${volume}%"]
+					},
+					"payload": {
+						"format": "json",
+						"schema": {
+							"channel": { "required": true, "enum": ["Master", "PCM"] },
+							"volume": { "min": 0, "max": 100 }
+						}
+					}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:  "Set volume",
+					Topic: "cmnd/volume",
+					Command: Command{
+						Name:      "/usr/bin/amixer",
+						Arguments: []string{"set", "${channel}", "${volume}%"},
+					},
+					Payload: &TriggerPayload{
+						Format: PayloadFormatJson,
+						Mode:   PayloadModeArguments,
+						Schema: map[string]PayloadField{
+							"channel": {Required: true, Enum: []string{"Master", "PCM"}},
+							"volume":  {Min: float(0), Max: float(100)},
+						},
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger invalid payload schema field",
+			content: `{
+				"trigger": [{
+					"name": "Set volume",
+					"topic": "cmnd/volume",
+					"command": {
+						"name": "/usr/bin/amixer"
+					},
+					"payload": { "schema": { "volume": {} } }
+				}]
+			}`,
+			expectedError: `invalid config: invalid trigger (#0): invalid payload schema: only the field "value" is available for the text format`,
+		},
+		{
+			name: "Trigger invalid payload schema range",
+			content: `{
+				"trigger": [{
+					"name": "Set volume",
+					"topic": "cmnd/volume",
+					"command": {
+						"name": "/usr/bin/amixer"
+					},
+					"payload": { "schema": { "value": { "min": 10, "max": 1 } } }
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid payload schema: min is greater than max: value",
+		},
+		{
+			name: "Trigger invalid payload mode",
+			content: `{
+				"trigger": [{
+					"name": "Set volume",
+					"topic": "cmnd/volume",
+					"command": {
+						"name": "/usr/bin/amixer"
+					},
+					"payload": { "mode": "file" }
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid payload mode",
+		},
+		{
+			name: "Trigger with concurrency",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup"
+					},
+					"concurrency": { "mode": "queue" }
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:  "Backup",
+					Topic: "cmnd/backup",
+					Command: Command{
+						Name: "/usr/bin/backup",
+					},
+					Concurrency: &Concurrency{
+						Mode:  ConcurrencyQueue,
+						Limit: DefaultConcurrencyLimit,
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger with rpc reply prefix",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup"
+					},
+					"rpc": true,
+					"rpc_reply_prefix": "reply/"
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:  "Backup",
+					Topic: "cmnd/backup",
+					Command: Command{
+						Name: "/usr/bin/backup",
+					},
+					Rpc:            true,
+					RpcReplyPrefix: "reply/",
+				}},
+			},
+		},
+		{
+			name: "Trigger rpc reply prefix without rpc",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup"
+					},
+					"rpc_reply_prefix": "reply/"
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): rpc reply prefix requires rpc mode",
+		},
+		{
+			name: "Trigger invalid rpc reply prefix",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup"
+					},
+					"rpc": true,
+					"rpc_reply_prefix": "reply/#"
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid rpc reply prefix: invalid character",
+		},
+		{
+			name: "Trigger invalid concurrency mode",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup"
+					},
+					"concurrency": { "mode": "fifo" }
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid concurrency mode",
+		},
+		{
+			name: "Trigger invalid concurrency limit",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup"
+					},
+					"concurrency": { "mode": "parallel", "limit": -1 }
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid concurrency limit",
+		},
+		{
+			name: "Trigger with home assistant component",
+			content: `{
+				"trigger": [{
+					"name": "Reboot",
+					"topic": "cmnd/reboot",
+					"ha_component": "button",
+					"command": {
+						"name": "/sbin/reboot"
+					}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:        "Reboot",
+					Topic:       "cmnd/reboot",
+					HaComponent: HaComponentButton,
+					Command: Command{
+						Name: "/sbin/reboot",
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger invalid home assistant component",
+			content: `{
+				"trigger": [{
+					"name": "Reboot",
+					"topic": "cmnd/reboot",
+					"ha_component": "light",
+					"command": {
+						"name": "/sbin/reboot"
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid home assistant component",
+		},
+		{
+			name: "Trigger with home assistant select",
+			content: `{
+				"trigger": [{
+					"name": "Mode",
+					"topic": "cmnd/mode",
+					"ha_component": "select",
+					"command": {
+						"name": "/usr/bin/mode",
+						"arguments": ["${value}"]
+					},
+					"payload": { "schema": { "value": { "enum": ["eco", "turbo"] } } }
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:        "Mode",
+					Topic:       "cmnd/mode",
+					HaComponent: HaComponentSelect,
+					Command: Command{
+						Name:      "/usr/bin/mode",
+						Arguments: []string{"${value}"},
+					},
+					Payload: &TriggerPayload{
+						Format: PayloadFormatText,
+						Mode:   PayloadModeArguments,
+						Schema: map[string]PayloadField{
+							"value": {Enum: []string{"eco", "turbo"}},
+						},
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger home assistant number without payload",
+			content: `{
+				"trigger": [{
+					"name": "Volume",
+					"topic": "cmnd/volume",
+					"ha_component": "number",
+					"command": {
+						"name": "/usr/bin/amixer"
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): home assistant component number requires a payload",
+		},
+		{
+			name: "Trigger with home assistant number",
+			content: `{
+				"trigger": [{
+					"name": "Volume",
+					"topic": "cmnd/volume",
+					"ha_component": "number",
+					"command": {
+						"name": "/usr/bin/amixer",
+						"arguments": ["${value}"]
+					},
+					"payload": { "schema": { "value": { "min": 0, "max": 100 } } }
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:        "Volume",
+					Topic:       "cmnd/volume",
+					HaComponent: HaComponentNumber,
+					Command: Command{
+						Name:      "/usr/bin/amixer",
+						Arguments: []string{"${value}"},
+					},
+					Payload: &TriggerPayload{
+						Format: PayloadFormatJson,
+						Mode:   PayloadModeArguments,
+						Schema: map[string]PayloadField{
+							"value": {Min: float(0), Max: float(100)},
+						},
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger home assistant text with text format",
+			content: `{
+				"trigger": [{
+					"name": "Message",
+					"topic": "cmnd/message",
+					"ha_component": "text",
+					"command": {
+						"name": "/usr/bin/notify"
+					},
+					"payload": { "format": "text" }
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): home assistant component text requires the payload format json",
+		},
+		{
+			name: "Trigger enum value collides with action",
+			content: `{
+				"trigger": [{
+					"name": "Mode",
+					"topic": "cmnd/mode",
+					"ha_component": "select",
+					"command": {
+						"name": "/usr/bin/mode"
+					},
+					"payload": { "schema": { "value": { "enum": ["eco", "Stop"] } } }
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid payload schema: enum value Stop of field value can not be distinguished from START and STOP",
+		},
+		{
+			name: "Trigger home assistant select without enum",
+			content: `{
+				"trigger": [{
+					"name": "Mode",
+					"topic": "cmnd/mode",
+					"ha_component": "select",
+					"command": {
+						"name": "/usr/bin/mode"
+					},
+					"payload": {}
+				}]
+			}`,
+			expectedError: `invalid config: invalid trigger (#0): home assistant component select requires the enum of the payload field "value"`,
+		},
+		{
+			name: "Trigger with timeout",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup",
+						"timeout": "1h",
+						"grace_period": "30s"
+					}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:  "Backup",
+					Topic: "cmnd/backup",
+					Command: Command{
+						Name:        "/usr/bin/backup",
+						Timeout:     *interval(time.Hour),
+						GracePeriod: *interval(30 * time.Second),
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger with environment",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup",
+						"env": { "TARGET": "/mnt/backup" },
+						"inherit_env": false,
+						"working_dir": "/",
+						"umask": "0027"
+					}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:  "Backup",
+					Topic: "cmnd/backup",
+					Command: Command{
+						Name:        "/usr/bin/backup",
+						Environment: map[string]string{"TARGET": "/mnt/backup"},
+						InheritEnv:  boolean(false),
+						WorkingDir:  "/",
+						Umask:       umask(0027),
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger invalid umask",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup",
+						"umask": "0999"
+					}
+				}]
+			}`,
+			expectedError: `could not read topic configuration file: invalid umask: strconv.ParseUint: parsing "0999": invalid syntax`,
+		},
+		{
+			name: "Trigger missing working directory",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup",
+						"working_dir": "/does/not/exist"
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): working directory does not exist",
+		},
+		{
+			name: "Trigger with user",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup",
+						"user": "root",
+						"group": "0",
+						"groups": ["root"]
+					}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:  "Backup",
+					Topic: "cmnd/backup",
+					Command: Command{
+						Name:   "/usr/bin/backup",
+						User:   "root",
+						Group:  "0",
+						Groups: []string{"root"},
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger unknown user",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup",
+						"user": "does-not-exist"
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): unknown user: does-not-exist",
+		},
+		{
+			name: "Trigger unknown group",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup",
+						"groups": ["does-not-exist"]
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): unknown group: does-not-exist",
+		},
+		{
+			name: "Trigger with result",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup"
+					},
+					"result": { "sub_topics": true }
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:  "Backup",
+					Topic: "cmnd/backup",
+					Command: Command{
+						Name: "/usr/bin/backup",
+					},
+					Result: &Result{
+						Format:    ResultFormatRaw,
+						SubTopics: true,
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger invalid result format",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup"
+					},
+					"result": { "format": "xml" }
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid result format",
+		},
+		{
+			name: "Trigger with stream",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup"
+					},
+					"stream": { "interval": "1s" }
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:  "Backup",
+					Topic: "cmnd/backup",
+					Command: Command{
+						Name: "/usr/bin/backup",
+					},
+					Stream: &Stream{
+						Interval: *interval(time.Second),
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger invalid truncate strategy",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"command": {
+						"name": "/usr/bin/backup",
+						"max_output_bytes": 1024,
+						"truncate": "middle"
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid truncate strategy",
+		},
+		{
+			name: "Trigger with schedule",
+			content: `{
+				"trigger": [{
+					"name": "Backup",
+					"topic": "cmnd/backup",
+					"schedule": "@daily",
+					"command": {
+						"name": "/usr/bin/backup"
+					}
+				}]
+			}`, expectedResult: TopicConfigurations{
+				Trigger: []Trigger{{
+					Name:     "Backup",
+					Topic:    "cmnd/backup",
+					Schedule: schedule("@daily"),
+					Command: Command{
+						Name: "/usr/bin/backup",
+					},
+				}},
+			},
+		},
+		{
+			name: "Trigger missing name",
+			content: `{
+				"trigger": [{
+					"topic": "tele/__DEVICE_ID__/status",
+					"command": {
+						"name": "/usr/bin/bash",
+						"arguments": ["echo"]
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): name must not be empty",
+		},
+		{
+			name: "Trigger invalid topic",
+			content: `{
+				"trigger": [{
+					"name": "My sweat sensor",
+					"topic": "tele/+/status",
+					"command": {
+						"name": "/usr/bin/bash",
+						"arguments": ["echo"]
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid topic: invalid character",
+		},
+		{
+			name: "Trigger empty topic",
+			content: `{
+				"trigger": [{
+					"name": "My sweat sensor",
+					"command": {
+						"name": "/usr/bin/bash",
+						"arguments": ["echo"]
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): invalid topic: must not be empty",
+		},
+		{
+			name: "Trigger empty command",
+			content: `{
+				"trigger": [{
+					"name": "My sweat sensor",
+					"topic": "tele/status",
+					"command": {
+						"arguments": ["echo"]
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#0): command name must not be empty",
+		},
+		{
+			name: "Trigger duplicate name",
+			content: `{
+				"trigger": [{
+					"name": "My sweat sensor",
+					"topic": "tele/status",
+					"command": {
+						"name": "/usr/bin/bash",
+						"arguments": ["echo"]
+					}
+				},{
+					"name": "My sweat sensor",
+					"topic": "tele/status",
+					"command": {
+						"name": "/usr/bin/bash",
+						"arguments": ["echo"]
+					}
+				}]
+			}`,
+			expectedError: "invalid config: invalid trigger (#1): trigger with this name already exists",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestLoadTopicConfiguration_"+tt.name, func(t *testing.T) {
+			tmpFile := testFile(tt.content)
+			defer os.Remove(tmpFile.Name())
+			defer tmpFile.Close()
+
+			configuration, err := LoadTopicConfiguration(tmpFile.Name(), deviceId)
+			if tt.expectedError != "" {
+				assert.Error(t, err)
+				assert.Equal(t, tt.expectedError, err.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectedResult, configuration)
+			}
+
+		})
+	}
+}
+
+func TestLoadTopicConfigurationWithFormat(t *testing.T) {
+	deviceId := "D3V1C3"
+	expected := TopicConfigurations{
+		Trigger: []Trigger{{
+			Name:  "Touch file",
+			Topic: fmt.Sprintf("cmnd/%s/touch", deviceId),
+			Command: Command{
+				Name:      "/usr/bin/touch",
+				Arguments: []string{"/tmp/example"},
+				Timeout:   *interval(time.Minute),
+			},
+		}},
+		Sensor: []Sensor{{
+			GeneralSensor: GeneralSensor{
+				ResultTopic: "tele/memory/free",
+				Interval:    *interval(10 * time.Second),
+				Command: Command{
+					Name: "/bin/cat",
+				},
+			},
+			Name: "Free Memory",
+			Unit: "kB",
+		}},
+	}
+
+	tests := []struct {
+		name          string
+		format        string
+		content       string
+		expectedError string
+	}{
+		{
+			name:   "json with comments",
+			format: FormatJson,
+			content: `{
+				// the trigger
+				"trigger": [{
+					"name": "Touch file", /* the name */
+					"topic": "cmnd/__DEVICE_ID__/touch",
+					"command": {
+						"name": "/usr/bin/touch",
+						"arguments": ["/tmp/example"],
+						"timeout": "1m", //trailing comma
+					}
+				}],
+				"sensor": [{
+					"name": "Free Memory",
+					"topic": "tele/memory/free",
+					"unit": "kB",
+					"interval": "10s",
+					"command": { "name": "/bin/cat" }
+				}]
+			}`,
+		},
+		{
+			name:   "yaml",
+			format: FormatYaml,
+			content: `
+# the trigger
+trigger:
+  - name: Touch file
+    topic: cmnd/__DEVICE_ID__/touch
+    command:
+      name: /usr/bin/touch
+      arguments: [/tmp/example]
+      timeout: 1m
+sensor:
+  - name: Free Memory
+    topic: tele/memory/free
+    unit: kB
+    interval: 10s
+    command:
+      name: /bin/cat
+`,
+		},
+		{
+			name:   "toml",
+			format: FormatToml,
+			content: `
+# the trigger
+[[trigger]]
+name = "Touch file"
+topic = "cmnd/__DEVICE_ID__/touch"
+command = { name = "/usr/bin/touch", arguments = ["/tmp/example"], timeout = "1m" }
+
+[[sensor]]
+name = "Free Memory"
+topic = "tele/memory/free"
+unit = "kB"
+interval = "10s"
+command = { name = "/bin/cat" }
+`,
+		},
+		{
+			name:          "empty yaml",
+			format:        FormatYaml,
+			expectedError: "could not read topic configuration file: EOF",
+		},
+		{
+			name:   "yaml validation",
+			format: FormatYaml,
+			content: `
+trigger:
+  - name: Touch file
+    topic: cmnd/+/touch
+    command:
+      name: /usr/bin/touch
+`,
+			expectedError: "invalid config: invalid trigger (#0): invalid topic: invalid character",
+		},
+		{
+			name:          "invalid toml",
+			format:        FormatToml,
+			content:       `trigger = [`,
+			expectedError: "could not read topic configuration file: toml: line 0 (last key \"trigger\"): unexpected EOF; expected value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestLoadTopicConfigurationWithFormat_"+tt.name, func(t *testing.T) {
+			tmpFile := testFile(tt.content)
+			defer os.Remove(tmpFile.Name())
+			defer tmpFile.Close()
+
+			configuration, err := LoadTopicConfigurationWithFormat(tmpFile.Name(), tt.format, deviceId)
+			if tt.expectedError != "" {
+				assert.Error(t, err)
+				assert.Equal(t, tt.expectedError, err.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, expected, configuration)
+			}
+		})
+	}
+}
+
+func TestLoadTopicConfigurationWithFormat_Umask(t *testing.T) {
+	tests := []struct {
+		name          string
+		format        string
+		content       string
+		expected      Umask
+		expectedError string
+	}{
+		{
+			name:     "json string",
+			format:   FormatJson,
+			content:  `{"trigger": [{"name": "Touch", "topic": "cmnd/touch", "command": {"name": "/usr/bin/touch", "umask": "0027"}}]}`,
+			expected: 0027,
+		},
+		{
+			name:     "json number",
+			format:   FormatJson,
+			content:  `{"trigger": [{"name": "Touch", "topic": "cmnd/touch", "command": {"name": "/usr/bin/touch", "umask": 23}}]}`,
+			expected: 0027,
+		},
+		{
+			name:   "yaml string",
+			format: FormatYaml,
+			content: `
+trigger:
+  - name: Touch
+    topic: cmnd/touch
+    command:
+      name: /usr/bin/touch
+      umask: "0027"
+`,
+			expected: 0027,
+		},
+		{
+			name:   "yaml number",
+			format: FormatYaml,
+			content: `
+trigger:
+  - name: Touch
+    topic: cmnd/touch
+    command:
+      name: /usr/bin/touch
+      umask: 0027
+`,
+			expected: 0027,
+		},
+		{
+			name:   "yaml octal",
+			format: FormatYaml,
+			content: `
+trigger:
+  - name: Touch
+    topic: cmnd/touch
+    command:
+      name: /usr/bin/touch
+      umask: 0o027
+`,
+			expected: 0027,
+		},
+		{
+			name:   "toml string",
+			format: FormatToml,
+			content: `
+[[trigger]]
+name = "Touch"
+topic = "cmnd/touch"
+command = { name = "/usr/bin/touch", umask = "0027" }
+`,
+			expected: 0027,
+		},
+		{
+			name:   "toml octal",
+			format: FormatToml,
+			content: `
+[[trigger]]
+name = "Touch"
+topic = "cmnd/touch"
+command = { name = "/usr/bin/touch", umask = 0o027 }
+`,
+			expected: 0027,
+		},
+		{
+			name:          "toml too large",
+			format:        FormatToml,
+			content:       "[[trigger]]\nname = \"Touch\"\ntopic = \"cmnd/touch\"\ncommand = { name = \"/usr/bin/touch\", umask = 0o1000 }",
+			expectedError: "could not read topic configuration file: invalid umask: 512",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestLoadTopicConfigurationWithFormat_Umask_"+tt.name, func(t *testing.T) {
+			tmpFile := testFile(tt.content)
+			defer os.Remove(tmpFile.Name())
+			defer tmpFile.Close()
+
+			configuration, err := LoadTopicConfigurationWithFormat(tmpFile.Name(), tt.format, "")
+			if tt.expectedError != "" {
+				assert.Error(t, err)
+				assert.Equal(t, tt.expectedError, err.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, umask(uint32(tt.expected)), configuration.Trigger[0].Command.Umask)
+			}
+		})
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	assert.Equal(t, FormatJson, DetectFormat("/etc/mqtt-executor/config.json"))
+	assert.Equal(t, FormatJson, DetectFormat("/etc/mqtt-executor/config"))
+	assert.Equal(t, FormatYaml, DetectFormat("/etc/mqtt-executor/config.yml"))
+	assert.Equal(t, FormatYaml, DetectFormat("/etc/mqtt-executor/config.YAML"))
+	assert.Equal(t, FormatToml, DetectFormat("/etc/mqtt-executor/config.toml"))
+}
+
+func TestStripJsonComments(t *testing.T) {
+	content := `{"broker": "tcp://host//path", /* comment
+with new line */ "list": [1, 2,], "escaped": "\"//" // end
+}`
+	stripped := stripJsonComments([]byte(content))
+
+	//the positions must be kept
+	assert.Equal(t, len(content), len(stripped))
+	assert.Equal(t, strings.Count(content, "\n"), strings.Count(string(stripped), "\n"))
+
+	var result map[string]interface{}
+	assert.NoError(t, json.Unmarshal(stripped, &result))
+	assert.Equal(t, map[string]interface{}{
+		"broker":  "tcp://host//path",
+		"list":    []interface{}{1.0, 2.0},
+		"escaped": `"//`,
+	}, result)
+}
+
+func testFile(content string) *os.File {
+	file, err := ioutil.TempFile("", "TestLoadTopicConfiguration")
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = file.WriteString(content)
+	if err != nil {
+		panic(err)
 	}
-
-	for _, tt := range tests {
-		t.Run("TestLoadTopicConfiguration_"+tt.name, func(t *testing.T) {
-			tmpFile := testFile(tt.content)
-			defer os.Remove(tmpFile.Name())
-			defer tmpFile.Close()
-
-			configuration, err := LoadTopicConfiguration(tmpFile.Name(), deviceId)
-			if tt.expectedError != "" {
-				assert.Error(t, err)
-				assert.Equal(t, tt.expectedError, err.Error())
-			} else {
-				assert.NoError(t, err)
-				assert.Equal(t, tt.expectedResult, configuration)
-			}
-
-		})
-	}
-}
-
-func testFile(content string) *os.File {
-	file, err := ioutil.TempFile("", "TestLoadTopicConfiguration")
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = file.WriteString(content)
-	if err != nil {
-		panic(err)
-	}
 
 	return file
 }
@@ -333,3 +1652,28 @@ func interval(d time.Duration) *Interval {
 	i := Interval(d)
 	return &i
 }
+
+func boolean(b bool) *bool {
+	return &b
+}
+
+func umask(u uint32) *Umask {
+	m := Umask(u)
+	return &m
+}
+
+func schedule(expression string) *Schedule {
+	s, err := scheduleParser.Parse(expression)
+	if err != nil {
+		panic(err)
+	}
+	return &Schedule{Schedule: s, Expression: expression}
+}
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func integer(i int) *int {
+	return &i
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+type Umask uint32
+
+func (u *Umask) UnmarshalJSON(b []byte) error {
+	var mask uint64
+	var err error
+
+	if len(b) > 0 && b[0] == '"' {
+		var value string
+		if err = json.Unmarshal(b, &value); err == nil {
+			mask, err = strconv.ParseUint(value, 8, 32)
+		}
+	} else {
+		//numbers are already decoded (ex. yaml "0027" or toml "0o027") and must not be interpreted as octal again
+		mask, err = strconv.ParseUint(string(b), 10, 32)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid umask: %w", err)
+	}
+	if mask > 0777 {
+		return fmt.Errorf("invalid umask: %s", b)
+	}
+
+	*u = Umask(mask)
+	return nil
+}
@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/rainu/mqtt-executor/internal/cmd"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"sort"
+	"time"
+)
+
+const (
+	ResultInterrupted = "<INTERRUPTED>"
+	ResultTimeout     = "<TIMEOUT>"
+	ResultFailed      = "<FAILED>"
+	ResultRejected    = "<REJECTED>"
+
+	EnvDeviceId    = "MQTT_EXECUTOR_DEVICE_ID"
+	EnvTriggerName = "MQTT_EXECUTOR_TRIGGER_NAME"
+	EnvTopic       = "MQTT_EXECUTOR_TOPIC"
+	EnvExecutionId = "MQTT_EXECUTOR_EXECUTION_ID"
+
+	EnvPropertyPrefix = "MQTT_EXECUTOR_PROPERTY_"
+)
+
+// newExecution creates the execution for the given command. The built-in variables will be exported
+// as environment variables to the process too.
+func newExecution(command config.Command, builtinEnv map[string]string) cmd.Execution {
+	execution := cmd.Execution{
+		Name:        command.Name,
+		Arguments:   command.Arguments,
+		Timeout:     time.Duration(command.Timeout),
+		GracePeriod: time.Duration(command.GracePeriod),
+		WorkingDir:  command.WorkingDir,
+		User:        command.User,
+		Group:       command.Group,
+		Groups:      command.Groups,
+
+		MaxOutputBytes: command.MaxOutputBytes,
+		Truncate:       command.Truncate,
+		LimitGroup:     command.LimitGroup,
+	}
+	if command.InheritEnv != nil {
+		execution.CleanEnvironment = !*command.InheritEnv
+	}
+	if command.Umask != nil {
+		umask := int(*command.Umask)
+		execution.Umask = &umask
+	}
+
+	//the configured variables should be able to overwrite the built-in ones
+	execution.Environment = append(execution.Environment, toEnv(builtinEnv)...)
+	execution.Environment = append(execution.Environment, toEnv(command.Environment)...)
+
+	return execution
+}
+
+// newExecutionId generates a random id for a command execution
+func newExecutionId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		//the random generator of the os should never fail
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+func toEnv(variables map[string]string) []string {
+	env := make([]string, 0, len(variables))
+	for name, value := range variables {
+		env = append(env, fmt.Sprintf("%s=%s", name, value))
+	}
+
+	//ensure a stable order
+	sort.Strings(env)
+	return env
+}
@@ -0,0 +1,59 @@
+package mqtt
+
+import (
+	"context"
+	"github.com/rainu/mqtt-executor/internal/cmd"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewExecution(t *testing.T) {
+	os.Setenv("MQTT_EXECUTOR_TEST_INHERITED", "inherited")
+	defer os.Unsetenv("MQTT_EXECUTOR_TEST_INHERITED")
+
+	workingDir, err := ioutil.TempDir("", "TestNewExecution")
+	assert.NoError(t, err)
+	defer os.RemoveAll(workingDir)
+
+	inheritEnv := false
+	umask := config.Umask(0027)
+
+	execution := newExecution(config.Command{
+		Name:      "/bin/sh",
+		Arguments: []string{"-c", `echo "pwd=$(pwd)"; echo "umask=$(umask)"; env`},
+		Environment: map[string]string{
+			"MY_VAR": "my value",
+			EnvTopic: "overwritten",
+		},
+		InheritEnv: &inheritEnv,
+		WorkingDir: workingDir,
+		Umask:      &umask,
+	}, map[string]string{
+		EnvDeviceId:    "D3V1C3",
+		EnvTriggerName: "test",
+		EnvTopic:       "cmnd/test",
+		EnvExecutionId: "1D",
+	})
+
+	result, err := cmd.NewCommandExecutor().ExecuteWithContext(execution, context.Background())
+	assert.NoError(t, err)
+
+	lines := strings.Split(string(result.Output), "\n")
+	assert.Contains(t, lines, "pwd="+workingDir)
+	assert.Contains(t, lines, "umask=0027")
+	assert.Contains(t, lines, "MY_VAR=my value")
+	assert.Contains(t, lines, "MQTT_EXECUTOR_DEVICE_ID=D3V1C3")
+	assert.Contains(t, lines, "MQTT_EXECUTOR_TRIGGER_NAME=test")
+	assert.Contains(t, lines, "MQTT_EXECUTOR_EXECUTION_ID=1D")
+
+	//the configured variables overwrite the built-in ones
+	assert.Contains(t, lines, "MQTT_EXECUTOR_TOPIC=overwritten")
+	assert.NotContains(t, lines, "MQTT_EXECUTOR_TOPIC=cmnd/test")
+
+	//the environment of the executor is not inherited
+	assert.NotContains(t, lines, "MQTT_EXECUTOR_TEST_INHERITED=inherited")
+}
@@ -1,15 +1,18 @@
 package hassio
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rainu/mqtt-executor/internal/mqtt"
 	"github.com/rainu/mqtt-executor/internal/mqtt/config"
 	"go.uber.org/zap"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type generalConfig struct {
@@ -19,27 +22,78 @@ type generalConfig struct {
 	PayloadNotAvailable string `json:"pl_not_avail,omitempty"`
 	UniqueId            string `json:"uniq_id"`
 	Icon                string `json:"ic,omitempty"`
+	DeviceClass         string `json:"dev_cla,omitempty"`
+	EntityCategory      string `json:"ent_cat,omitempty"`
 	Device              device `json:"dev,omitempty"`
 }
 
 type sensorConfig struct {
 	generalConfig
 
-	StateTopic      string `json:"stat_t"`
-	MeasurementUnit string `json:"unit_of_meas,omitempty"`
-	ValueTemplate   string `json:"value_template,omitempty"`
-	ForceUpdate     *bool  `json:"frc_upd,omitempty"`
+	StateTopic       string `json:"stat_t"`
+	MeasurementUnit  string `json:"unit_of_meas,omitempty"`
+	ValueTemplate    string `json:"value_template,omitempty"`
+	ForceUpdate      *bool  `json:"frc_upd,omitempty"`
+	StateClass       string `json:"stat_cla,omitempty"`
+	DisplayPrecision *int   `json:"sug_dsp_prc,omitempty"`
+	ExpireAfter      int    `json:"exp_aft,omitempty"`
+}
+
+type binarySensorConfig struct {
+	generalConfig
+
+	StateTopic    string `json:"stat_t"`
+	ValueTemplate string `json:"value_template,omitempty"`
+	PayloadOn     string `json:"pl_on,omitempty"`
+	PayloadOff    string `json:"pl_off,omitempty"`
+	ExpireAfter   int    `json:"exp_aft,omitempty"`
 }
 
 type triggerConfig struct {
 	generalConfig
 
+	CommandTopic  string `json:"cmd_t"`
+	StateTopic    string `json:"stat_t"`
+	PayloadStart  string `json:"pl_on"`
+	PayloadStop   string `json:"pl_off"`
+	StateRunning  string `json:"stat_on"`
+	StateStopped  string `json:"stat_off"`
+	ValueTemplate string `json:"value_template,omitempty"`
+}
+
+type buttonConfig struct {
+	generalConfig
+
 	CommandTopic string `json:"cmd_t"`
-	StateTopic   string `json:"stat_t"`
-	PayloadStart string `json:"pl_on"`
-	PayloadStop  string `json:"pl_off"`
-	StateRunning string `json:"stat_on"`
-	StateStopped string `json:"stat_off"`
+	PayloadPress string `json:"pl_prs"`
+}
+
+// inputConfig is the base of all entities which pass their value to the trigger's command
+type inputConfig struct {
+	generalConfig
+
+	CommandTopic    string `json:"cmd_t"`
+	CommandTemplate string `json:"cmd_tpl,omitempty"`
+}
+
+type numberConfig struct {
+	inputConfig
+
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+	Step *float64 `json:"step,omitempty"`
+}
+
+type selectConfig struct {
+	inputConfig
+
+	Options []string `json:"options"`
+}
+
+type textConfig struct {
+	inputConfig
+
+	Pattern string `json:"pattern,omitempty"`
 }
 
 type device struct {
@@ -56,55 +110,223 @@ type AvailabilityConfig struct {
 	NotAvailablePayload string
 }
 
+// manifestTimeout is the maximum time to wait for the retained manifest
+var manifestTimeout = 2 * time.Second
+
+// PayloadOnline is the payload of home assistant's birth message
+const PayloadOnline = "online"
+
 type Client struct {
 	DeviceName  string
 	DeviceId    string
 	TopicPrefix string
-	MqttClient  MQTT.Client
+	StatusTopic string
+	MqttClient  mqtt.Client
+
+	//the last published discovery configs (topic -> payload)
+	lock      sync.Mutex
+	published map[string][]byte
+}
+
+// SubscribeStatus subscribes home assistant's status topic. If home assistant comes online (ex. after a restart)
+// all discovery configs will be republished and the given function will be called.
+func (c *Client) SubscribeStatus(onOnline func()) {
+	if c.StatusTopic == "" {
+		return
+	}
+
+	c.MqttClient.Subscribe(c.StatusTopic, byte(1), func(message mqtt.Message) {
+		if strings.TrimSpace(string(message.Payload)) != PayloadOnline {
+			return
+		}
+
+		//do not block the message handling
+		go func() {
+			zap.L().Info("Homeassistant is online.")
+			c.RepublishDiscoveryConfig()
+			onOnline()
+		}()
+	})
+}
+
+// RepublishDiscoveryConfig publishes all (already published) discovery configs again
+func (c *Client) RepublishDiscoveryConfig() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for targetTopic, payload := range c.published {
+		c.MqttClient.Publish(targetTopic, byte(1), false, payload)
+	}
 }
 
+// PublishDiscoveryConfig publishes all discovery configs. Discovery configs of the last run (see manifest) which are
+// not available anymore will be removed.
 func (c *Client) PublishDiscoveryConfig(config config.TopicConfigurations) {
 	zap.L().Info("Initialise homeassistant config.")
 
+	//waiting for the manifest can take a while - the other operations must not be blocked meanwhile
+	manifest := c.loadManifest()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.published = c.generateDiscoveryConfigs(config)
+	for _, targetTopic := range manifest {
+		if _, exists := c.published[targetTopic]; !exists {
+			zap.L().Info("Remove stale homeassistant config.", zap.String("topic", targetTopic))
+			c.removeDiscoveryConfig(targetTopic)
+		}
+	}
+	for targetTopic, payload := range c.published {
+		c.MqttClient.Publish(targetTopic, byte(1), false, payload)
+	}
+	c.publishManifest()
+}
+
+// RemoveDiscoveryConfig removes all discovery configs of this device (the current and the ones of the last run)
+func (c *Client) RemoveDiscoveryConfig(config config.TopicConfigurations) {
+	zap.L().Info("Remove homeassistant config.")
+
+	//waiting for the manifest can take a while - the other operations must not be blocked meanwhile
+	manifest := c.loadManifest()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	discoveryConfigs := c.generateDiscoveryConfigs(config)
+	for _, targetTopic := range manifest {
+		discoveryConfigs[targetTopic] = nil
+	}
+	for targetTopic := range discoveryConfigs {
+		c.removeDiscoveryConfig(targetTopic)
+	}
+
+	//an empty retained message removes the manifest
+	c.published = nil
+	c.MqttClient.Publish(c.manifestTopic(), byte(1), true, []byte{}).Wait()
+}
+
+// UpdateDiscoveryConfig publishes only the new or changed discovery configs. Discovery configs which are not
+// available anymore will be removed.
+func (c *Client) UpdateDiscoveryConfig(config config.TopicConfigurations) {
+	zap.L().Info("Update homeassistant config.")
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	discoveryConfigs := c.generateDiscoveryConfigs(config)
+	for targetTopic := range c.published {
+		if _, exists := discoveryConfigs[targetTopic]; !exists {
+			c.removeDiscoveryConfig(targetTopic)
+		}
+	}
+	for targetTopic, payload := range discoveryConfigs {
+		if !bytes.Equal(c.published[targetTopic], payload) {
+			c.MqttClient.Publish(targetTopic, byte(1), false, payload)
+		}
+	}
+
+	c.published = discoveryConfigs
+	c.publishManifest()
+}
+
+func (c *Client) removeDiscoveryConfig(targetTopic string) {
+	//an empty payload will remove the entity (retained so that a possibly retained config will be removed too)
+	c.MqttClient.Publish(targetTopic, byte(1), true, []byte{})
+}
+
+// manifestTopic is the topic of the manifest which contains all published discovery topics (so that we can remove
+// them on the next run if they are not available anymore)
+func (c *Client) manifestTopic() string {
+	return fmt.Sprintf("%smqtt-executor/%s/manifest", c.TopicPrefix, c.DeviceId)
+}
+
+func (c *Client) publishManifest() {
+	targetTopics := make([]string, 0, len(c.published))
+	for targetTopic := range c.published {
+		targetTopics = append(targetTopics, targetTopic)
+	}
+	sort.Strings(targetTopics)
+
+	payload, err := json.Marshal(targetTopics)
+	if err != nil {
+		//the "marshalling" is relatively safe - it should never appear at runtime
+		panic(err)
+	}
+	c.MqttClient.Publish(c.manifestTopic(), byte(1), true, payload)
+}
+
+// loadManifest returns the discovery topics of the (retained) manifest
+func (c *Client) loadManifest() []string {
+	received := make(chan []byte, 1)
+	token := c.MqttClient.Subscribe(c.manifestTopic(), byte(1), func(message mqtt.Message) {
+		select {
+		case received <- message.Payload:
+		default:
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		zap.L().Warn("Could not subscribe homeassistant manifest.", zap.Error(token.Error()))
+		return nil
+	}
+	defer c.MqttClient.Unsubscribe(c.manifestTopic()).Wait()
+
+	var payload []byte
+	select {
+	case payload = <-received:
+	case <-time.After(manifestTimeout):
+		//there is no manifest (ex. first run)
+		return nil
+	}
+
+	var targetTopics []string
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &targetTopics); err != nil {
+			zap.L().Warn("Invalid homeassistant manifest.", zap.Error(err))
+			return nil
+		}
+	}
+	return targetTopics
+}
+
+func (c *Client) generateDiscoveryConfigs(config config.TopicConfigurations) map[string][]byte {
+	discoveryConfigs := map[string][]byte{}
+
 	//status
 	if config.Availability != nil {
 		targetTopic := fmt.Sprintf("%ssensor/%s_status/config", c.TopicPrefix, c.DeviceId)
-		payload := c.generatePayloadForStatus(config.Availability)
-		c.MqttClient.Publish(targetTopic, byte(1), false, payload)
+		discoveryConfigs[targetTopic] = c.generatePayloadForStatus(config.Availability)
 	}
 
 	//sensor
 	for _, sensor := range config.Sensor {
-		targetTopic := fmt.Sprintf("%ssensor/%s_%s/config", c.TopicPrefix, c.DeviceId, friendlyName(sensor.Name))
-		payload := c.generatePayloadForSensor(config.Availability, sensor)
-		c.MqttClient.Publish(targetTopic, byte(1), false, payload)
+		targetTopic := fmt.Sprintf("%s%s/%s_%s/config", c.TopicPrefix, sensorComponent(sensor.HaComponent), c.DeviceId, friendlyName(sensor.Name))
+		discoveryConfigs[targetTopic] = c.generatePayloadForSensor(config.Availability, sensor)
 	}
 
 	//multi sensor
 	for _, sensor := range config.MultiSensor {
 		for _, sensorValue := range sensor.Values {
-			targetTopic := fmt.Sprintf("%ssensor/%s_%s/config", c.TopicPrefix, c.DeviceId, friendlyName(sensorValue.Name))
-			payload := c.generatePayloadForMultiSensor(config.Availability, sensor, sensorValue)
-			c.MqttClient.Publish(targetTopic, byte(1), false, payload)
+			targetTopic := fmt.Sprintf("%s%s/%s_%s/config", c.TopicPrefix, sensorComponent(sensorValue.HaComponent), c.DeviceId, friendlyName(sensorValue.Name))
+			discoveryConfigs[targetTopic] = c.generatePayloadForMultiSensor(config.Availability, sensor, sensorValue)
 		}
 	}
 
 	//trigger
 	for _, trigger := range config.Trigger {
-		targetTopic := fmt.Sprintf("%sswitch/%s/%s/config", c.TopicPrefix, c.DeviceId, friendlyName(trigger.Name))
-		payload := c.generateSwitchPayloadForTriggerAction(config.Availability, trigger)
-		c.MqttClient.Publish(targetTopic, byte(1), false, payload)
+		targetTopic := fmt.Sprintf("%s%s/%s/%s/config", c.TopicPrefix, haComponent(trigger), c.DeviceId, friendlyName(trigger.Name))
+		discoveryConfigs[targetTopic] = c.generatePayloadForTriggerAction(config.Availability, trigger)
 
 		//publish the trigger-result as sensor data
 		targetTopic = fmt.Sprintf("%ssensor/%s_%s/result/config", c.TopicPrefix, c.DeviceId, friendlyName(trigger.Name))
-		payload = c.generateResultPayloadForTriggerAction(config.Availability, trigger)
-		c.MqttClient.Publish(targetTopic, byte(1), false, payload)
+		discoveryConfigs[targetTopic] = c.generateResultPayloadForTriggerAction(config.Availability, trigger)
 
 		//publish the trigger-state as sensor data
 		targetTopic = fmt.Sprintf("%ssensor/%s_%s/state/config", c.TopicPrefix, c.DeviceId, friendlyName(trigger.Name))
-		payload = c.generateStatePayloadForTriggerAction(config.Availability, trigger)
-		c.MqttClient.Publish(targetTopic, byte(1), false, payload)
+		discoveryConfigs[targetTopic] = c.generateStatePayloadForTriggerAction(config.Availability, trigger)
 	}
+
+	return discoveryConfigs
 }
 
 func friendlyName(name string) string {
@@ -159,8 +381,15 @@ func (c *Client) generatePayloadForSensor(availability *config.Availability, sen
 		ForceUpdate:     &bTrue,
 	}
 	addAvailability(&conf.generalConfig, availability)
+	addSensorEntity(&conf, sensor.HaEntity)
+	conf.ExpireAfter = expireAfter(sensor.HaEntity, sensor.GeneralSensor)
 
-	payload, err := json.Marshal(conf)
+	var discoveryConfig interface{} = conf
+	if sensorComponent(sensor.HaComponent) == config.HaComponentBinarySensor {
+		discoveryConfig = toBinarySensorConfig(conf, sensor.HaBinary)
+	}
+
+	payload, err := json.Marshal(discoveryConfig)
 	if err != nil {
 		//the "marshalling" is relatively safe - it should never appear at runtime
 		panic(err)
@@ -182,9 +411,21 @@ func (c *Client) generatePayloadForMultiSensor(availability *config.Availability
 		MeasurementUnit: sensorValue.Unit,
 		ForceUpdate:     &bTrue,
 	}
+	if sensor.FanOut {
+		//the value will be published to its own topic -> no template is needed
+		conf.StateTopic = sensor.ValueTopic(sensorValue)
+		conf.ValueTemplate = ""
+	}
 	addAvailability(&conf.generalConfig, availability)
+	addSensorEntity(&conf, sensorValue.HaEntity)
+	conf.ExpireAfter = expireAfter(sensorValue.HaEntity, sensor.GeneralSensor)
 
-	payload, err := json.Marshal(conf)
+	var discoveryConfig interface{} = conf
+	if sensorComponent(sensorValue.HaComponent) == config.HaComponentBinarySensor {
+		discoveryConfig = toBinarySensorConfig(conf, sensorValue.HaBinary)
+	}
+
+	payload, err := json.Marshal(discoveryConfig)
 	if err != nil {
 		//the "marshalling" is relatively safe - it should never appear at runtime
 		panic(err)
@@ -192,6 +433,32 @@ func (c *Client) generatePayloadForMultiSensor(availability *config.Availability
 	return payload
 }
 
+// toBinarySensorConfig converts the sensor config into a binary sensor config
+func toBinarySensorConfig(conf sensorConfig, binary *config.HaBinary) binarySensorConfig {
+	binaryConf := binarySensorConfig{
+		generalConfig: conf.generalConfig,
+		StateTopic:    conf.StateTopic,
+		ValueTemplate: conf.ValueTemplate,
+		ExpireAfter:   conf.ExpireAfter,
+	}
+	if binary != nil {
+		binaryConf.PayloadOn = binary.On
+		binaryConf.PayloadOff = binary.Off
+	}
+	return binaryConf
+}
+
+func (c *Client) generatePayloadForTriggerAction(availability *config.Availability, trigger config.Trigger) []byte {
+	switch haComponent(trigger) {
+	case config.HaComponentButton:
+		return c.generateButtonPayloadForTriggerAction(availability, trigger)
+	case config.HaComponentNumber, config.HaComponentSelect, config.HaComponentText:
+		return c.generateInputPayloadForTriggerAction(availability, trigger)
+	default:
+		return c.generateSwitchPayloadForTriggerAction(availability, trigger)
+	}
+}
+
 func (c *Client) generateSwitchPayloadForTriggerAction(availability *config.Availability, trigger config.Trigger) []byte {
 	conf := triggerConfig{
 		generalConfig: generalConfig{
@@ -208,6 +475,7 @@ func (c *Client) generateSwitchPayloadForTriggerAction(availability *config.Avai
 		StateStopped: mqtt.PayloadStatusStopped,
 	}
 	addAvailability(&conf.generalConfig, availability)
+	addEntity(&conf.generalConfig, trigger.HaEntity)
 
 	payload, err := json.Marshal(conf)
 	if err != nil {
@@ -217,6 +485,77 @@ func (c *Client) generateSwitchPayloadForTriggerAction(availability *config.Avai
 	return payload
 }
 
+func (c *Client) generateButtonPayloadForTriggerAction(availability *config.Availability, trigger config.Trigger) []byte {
+	conf := buttonConfig{
+		generalConfig: generalConfig{
+			Name:     trigger.Name,
+			Icon:     trigger.Icon,
+			UniqueId: fmt.Sprintf("%s_%s", c.DeviceId, friendlyName(trigger.Name)),
+			Device:   c.buildDevice(),
+		},
+		CommandTopic: trigger.Topic,
+		PayloadPress: mqtt.PayloadStart,
+	}
+	addAvailability(&conf.generalConfig, availability)
+	addEntity(&conf.generalConfig, trigger.HaEntity)
+
+	payload, err := json.Marshal(conf)
+	if err != nil {
+		//the "marshalling" is relatively safe - it should never appear at runtime
+		panic(err)
+	}
+	return payload
+}
+
+func (c *Client) generateInputPayloadForTriggerAction(availability *config.Availability, trigger config.Trigger) []byte {
+	input := inputConfig{
+		generalConfig: generalConfig{
+			Name:     trigger.Name,
+			Icon:     trigger.Icon,
+			UniqueId: fmt.Sprintf("%s_%s", c.DeviceId, friendlyName(trigger.Name)),
+			Device:   c.buildDevice(),
+		},
+		CommandTopic: trigger.Topic,
+	}
+	if trigger.Payload.Format == config.PayloadFormatJson {
+		//the command expects a json object which contains the value
+		input.CommandTemplate = fmt.Sprintf(`{"%s": {{ value | tojson }}}`, config.PayloadValueField)
+	}
+	addAvailability(&input.generalConfig, availability)
+	addEntity(&input.generalConfig, trigger.HaEntity)
+
+	field := trigger.Payload.Schema[config.PayloadValueField]
+
+	var discoveryConfig interface{}
+	switch haComponent(trigger) {
+	case config.HaComponentNumber:
+		discoveryConfig = numberConfig{
+			inputConfig: input,
+			Min:         field.Min,
+			Max:         field.Max,
+			Step:        field.Step,
+		}
+	case config.HaComponentSelect:
+		discoveryConfig = selectConfig{
+			inputConfig: input,
+			Options:     field.Enum,
+		}
+	default:
+		conf := textConfig{inputConfig: input}
+		if field.Regex != nil && field.Regex.Regexp != nil {
+			conf.Pattern = field.Regex.String()
+		}
+		discoveryConfig = conf
+	}
+
+	payload, err := json.Marshal(discoveryConfig)
+	if err != nil {
+		//the "marshalling" is relatively safe - it should never appear at runtime
+		panic(err)
+	}
+	return payload
+}
+
 func (c *Client) generateResultPayloadForTriggerAction(availability *config.Availability, trigger config.Trigger) []byte {
 	conf := sensorConfig{
 		generalConfig: generalConfig{
@@ -227,7 +566,17 @@ func (c *Client) generateResultPayloadForTriggerAction(availability *config.Avai
 		},
 		StateTopic: fmt.Sprintf("%s/%s", trigger.Topic, mqtt.TopicSuffixResult),
 	}
+	if isParallel(trigger) && (trigger.Result == nil || trigger.Result.Format != config.ResultFormatJson) {
+		//the result contains the execution id: <ID>;<RESULT>
+		conf.ValueTemplate = "{{ value.split(';', 1)[-1] }}"
+	}
 	addAvailability(&conf.generalConfig, availability)
+	addSensorEntity(&conf, trigger.HaEntity)
+	conf.DeviceClass = "" //the device class belongs to the trigger entity
+	conf.EntityCategory = sensorEntityCategory(trigger.HaEntity)
+	if trigger.ExpireAfter != nil {
+		conf.ExpireAfter = int(time.Duration(*trigger.ExpireAfter) / time.Second)
+	}
 
 	payload, err := json.Marshal(conf)
 	if err != nil {
@@ -248,6 +597,7 @@ func (c *Client) generateStatePayloadForTriggerAction(availability *config.Avail
 		StateTopic: fmt.Sprintf("%s/%s", trigger.Topic, mqtt.TopicSuffixState),
 	}
 	addAvailability(&conf.generalConfig, availability)
+	conf.EntityCategory = sensorEntityCategory(trigger.HaEntity)
 
 	payload, err := json.Marshal(conf)
 	if err != nil {
@@ -257,6 +607,66 @@ func (c *Client) generateStatePayloadForTriggerAction(availability *config.Avail
 	return payload
 }
 
+func haComponent(trigger config.Trigger) string {
+	if trigger.HaComponent == "" {
+		return config.HaComponentSwitch
+	}
+	return trigger.HaComponent
+}
+
+func sensorComponent(component string) string {
+	if component == "" {
+		return config.HaComponentSensor
+	}
+	return component
+}
+
+func isParallel(trigger config.Trigger) bool {
+	return trigger.Concurrency != nil && trigger.Concurrency.Mode == config.ConcurrencyParallel
+}
+
+// addEntity adds the home assistant settings which are available for all entities
+func addEntity(config *generalConfig, entity config.HaEntity) {
+	config.DeviceClass = entity.DeviceClass
+	config.EntityCategory = entity.EntityCategory
+}
+
+func addSensorEntity(config *sensorConfig, entity config.HaEntity) {
+	addEntity(&config.generalConfig, entity)
+	config.StateClass = entity.StateClass
+	config.DisplayPrecision = entity.DisplayPrecision
+}
+
+// sensorEntityCategory returns the entity category for the sensors of a trigger (home assistant does not allow
+// the category "config" for sensors)
+func sensorEntityCategory(entity config.HaEntity) string {
+	if entity.EntityCategory == "" {
+		return ""
+	}
+	return config.HaEntityCategoryDiagnostic
+}
+
+// expireAfterIntervals is the number of missed intervals after that a sensor value will be unavailable (by default)
+const expireAfterIntervals = 3
+
+// expireAfter returns the time (in seconds) after that the sensor value will be unavailable (0 means never)
+func expireAfter(entity config.HaEntity, sensor config.GeneralSensor) int {
+	if entity.ExpireAfter != nil {
+		return int(time.Duration(*entity.ExpireAfter) / time.Second)
+	}
+	if sensor.Schedule != nil {
+		//the time between two executions is not fixed
+		return 0
+	}
+
+	//the sensor value will be published at least once per (force) interval
+	interval := sensor.Interval
+	if sensor.PublishMode != "" && sensor.PublishMode != config.PublishModeAlways {
+		interval = sensor.ForceInterval
+	}
+	return expireAfterIntervals * int(time.Duration(interval)/time.Second)
+}
+
 func addAvailability(config *generalConfig, availability *config.Availability) {
 	if availability != nil {
 		config.AvailabilityTopic = availability.Topic
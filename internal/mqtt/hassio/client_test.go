@@ -0,0 +1,634 @@
+package hassio
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rainu/mqtt-executor/internal/mqtt"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type publishedMessage struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+// fakeClient records all published messages and delivers the retained messages on subscription (like a broker)
+type fakeClient struct {
+	lock      sync.Mutex
+	published []publishedMessage
+	retained  map[string][]byte
+	handlers  map[string]mqtt.MessageHandler
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool   { return true }
+func (doneToken) Error() error { return nil }
+
+func (f *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return f.PublishWithProperties(topic, qos, retained, payload, mqtt.PublishProperties{})
+}
+
+func (f *fakeClient) PublishWithProperties(topic string, _ byte, retained bool, payload interface{}, _ mqtt.PublishProperties) mqtt.Token {
+	content := payload.([]byte)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.published = append(f.published, publishedMessage{topic: topic, payload: string(content), retained: retained})
+	if retained {
+		if f.retained == nil {
+			f.retained = map[string][]byte{}
+		}
+		if len(content) == 0 {
+			delete(f.retained, topic)
+		} else {
+			f.retained[topic] = content
+		}
+	}
+	return doneToken{}
+}
+
+func (f *fakeClient) Subscribe(topic string, _ byte, handler mqtt.MessageHandler) mqtt.Token {
+	f.lock.Lock()
+	if f.handlers == nil {
+		f.handlers = map[string]mqtt.MessageHandler{}
+	}
+	f.handlers[topic] = handler
+	payload, exists := f.retained[topic]
+	f.lock.Unlock()
+
+	if exists {
+		handler(mqtt.Message{Topic: topic, Payload: payload})
+	}
+	return doneToken{}
+}
+
+func (f *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, topic := range topics {
+		delete(f.handlers, topic)
+	}
+	return doneToken{}
+}
+
+func (f *fakeClient) receive(topic, payload string) {
+	f.lock.Lock()
+	handler := f.handlers[topic]
+	f.lock.Unlock()
+
+	handler(mqtt.Message{Topic: topic, Payload: []byte(payload)})
+}
+
+func (f *fakeClient) Disconnect(time.Duration) {}
+
+// reset forgets all published (but not the retained) messages
+func (f *fakeClient) reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.published = nil
+}
+
+// topics returns the topics of all published messages (excluding the manifest) and whether the message was a removal
+func (f *fakeClient) topics() map[string]bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	topics := map[string]bool{}
+	for _, message := range f.published {
+		if message.topic != "homeassistant/mqtt-executor/D3V1C3/manifest" {
+			topics[message.topic] = message.payload == ""
+		}
+	}
+	return topics
+}
+
+func newTestClient(mqttClient *fakeClient) *Client {
+	return &Client{
+		DeviceName:  "Device",
+		DeviceId:    "D3V1C3",
+		TopicPrefix: "homeassistant/",
+		MqttClient:  mqttClient,
+	}
+}
+
+func testSensor(name, unit string) config.Sensor {
+	return config.Sensor{
+		GeneralSensor: config.GeneralSensor{ResultTopic: "tele/" + name},
+		Name:          name,
+		Unit:          unit,
+	}
+}
+
+func TestClient_UpdateDiscoveryConfig(t *testing.T) {
+	mqttClient := &fakeClient{retained: map[string][]byte{
+		"homeassistant/mqtt-executor/D3V1C3/manifest": []byte(`[]`),
+	}}
+	client := newTestClient(mqttClient)
+
+	client.PublishDiscoveryConfig(config.TopicConfigurations{
+		Sensor: []config.Sensor{testSensor("unchanged", "kB"), testSensor("changed", "kB")},
+		Trigger: []config.Trigger{{
+			Name:    "removed",
+			Topic:   "cmnd/removed",
+			Command: config.Command{Name: "/bin/true"},
+		}},
+	})
+	mqttClient.reset()
+
+	client.UpdateDiscoveryConfig(config.TopicConfigurations{
+		Sensor: []config.Sensor{testSensor("unchanged", "kB"), testSensor("changed", "MB"), testSensor("added", "kB")},
+	})
+
+	//topic -> removed
+	assert.Equal(t, map[string]bool{
+		"homeassistant/sensor/D3V1C3_changed/config":        false,
+		"homeassistant/sensor/D3V1C3_added/config":          false,
+		"homeassistant/switch/D3V1C3/removed/config":        true,
+		"homeassistant/sensor/D3V1C3_removed/result/config": true,
+		"homeassistant/sensor/D3V1C3_removed/state/config":  true,
+	}, mqttClient.topics())
+
+	//the manifest contains the current discovery topics
+	assert.JSONEq(t, `[
+		"homeassistant/sensor/D3V1C3_added/config",
+		"homeassistant/sensor/D3V1C3_changed/config",
+		"homeassistant/sensor/D3V1C3_unchanged/config"
+	]`, string(mqttClient.retained["homeassistant/mqtt-executor/D3V1C3/manifest"]))
+}
+
+func TestClient_ButtonDiscoveryConfig(t *testing.T) {
+	client := newTestClient(&fakeClient{})
+
+	discoveryConfigs := client.generateDiscoveryConfigs(config.TopicConfigurations{
+		Availability: &config.Availability{Topic: "tele/D3V1C3/status"},
+		Trigger: []config.Trigger{{
+			Name:        "Restart Service",
+			Topic:       "cmnd/restart",
+			Icon:        "mdi:restart",
+			Command:     config.Command{Name: "/bin/true"},
+			HaComponent: config.HaComponentButton,
+			HaEntity: config.HaEntity{
+				DeviceClass:    "restart",
+				EntityCategory: config.HaEntityCategoryConfig,
+			},
+		}},
+	})
+
+	assert.Contains(t, discoveryConfigs, "homeassistant/button/D3V1C3/Restart_Service/config")
+	assert.NotContains(t, discoveryConfigs, "homeassistant/switch/D3V1C3/Restart_Service/config")
+	assert.JSONEq(t, fmt.Sprintf(`{
+		"name": "Restart Service",
+		"avty_t": "tele/D3V1C3/status",
+		"uniq_id": "D3V1C3_Restart_Service",
+		"ic": "mdi:restart",
+		"dev_cla": "restart",
+		"ent_cat": "config",
+		"dev": {"name": "Device", "ids": ["D3V1C3"], "mdl": "%s", "mf": "rainu", "sw": "mqtt-executor"},
+		"cmd_t": "cmnd/restart",
+		"pl_prs": "START"
+	}`, runtime.GOOS), string(discoveryConfigs["homeassistant/button/D3V1C3/Restart_Service/config"]))
+}
+
+func TestClient_InputDiscoveryConfig(t *testing.T) {
+	tests := []struct {
+		name             string
+		component        string
+		payload          config.TriggerPayload
+		expectedTemplate interface{}
+	}{
+		{
+			name:             "number",
+			component:        config.HaComponentNumber,
+			payload:          config.TriggerPayload{Format: config.PayloadFormatJson},
+			expectedTemplate: `{"value": {{ value | tojson }}}`,
+		},
+		{
+			name:             "text",
+			component:        config.HaComponentText,
+			payload:          config.TriggerPayload{Format: config.PayloadFormatJson},
+			expectedTemplate: `{"value": {{ value | tojson }}}`,
+		},
+		{
+			name:      "select",
+			component: config.HaComponentSelect,
+			payload: config.TriggerPayload{
+				Format: config.PayloadFormatText,
+				Schema: map[string]config.PayloadField{config.PayloadValueField: {Enum: []string{"eco", "comfort"}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run("TestClient_InputDiscoveryConfig_"+tt.name, func(t *testing.T) {
+			client := newTestClient(&fakeClient{})
+
+			discoveryConfigs := client.generateDiscoveryConfigs(config.TopicConfigurations{
+				Trigger: []config.Trigger{{
+					Name:        "Input",
+					Topic:       "cmnd/input",
+					Command:     config.Command{Name: "/bin/true"},
+					Payload:     &tt.payload,
+					HaComponent: tt.component,
+				}},
+			})
+
+			discoveryConfig := map[string]interface{}{}
+			assert.NoError(t, json.Unmarshal(discoveryConfigs[fmt.Sprintf("homeassistant/%s/D3V1C3/Input/config", tt.component)], &discoveryConfig))
+			assert.Equal(t, "cmnd/input", discoveryConfig["cmd_t"])
+			assert.Equal(t, tt.expectedTemplate, discoveryConfig["cmd_tpl"])
+		})
+	}
+}
+
+func TestClient_BinarySensorDiscoveryConfig(t *testing.T) {
+	precision := 2
+	binaryEntity := config.HaEntity{DeviceClass: "door", StateClass: "measurement", DisplayPrecision: &precision}
+
+	tests := []struct {
+		name            string
+		topicConfig     config.TopicConfigurations
+		expectedTopic   string
+		expectedPayload string
+	}{
+		{
+			name: "sensor",
+			topicConfig: config.TopicConfigurations{Sensor: []config.Sensor{{
+				GeneralSensor: config.GeneralSensor{
+					ResultTopic: "tele/door",
+					Interval:    config.Interval(10 * time.Second),
+				},
+				Name:        "Door",
+				Unit:        "kB",
+				HaComponent: config.HaComponentBinarySensor,
+				HaBinary:    &config.HaBinary{On: "open", Off: "closed"},
+				HaEntity:    binaryEntity,
+			}}},
+			expectedTopic: "homeassistant/binary_sensor/D3V1C3_Door/config",
+			expectedPayload: `{
+				"name": "Door",
+				"uniq_id": "D3V1C3_Door",
+				"dev_cla": "door",
+				"dev": {"name": "Device", "ids": ["D3V1C3"], "mdl": "%s", "mf": "rainu", "sw": "mqtt-executor"},
+				"stat_t": "tele/door",
+				"pl_on": "open",
+				"pl_off": "closed",
+				"exp_aft": 30
+			}`,
+		},
+		{
+			name: "multi sensor value",
+			topicConfig: config.TopicConfigurations{MultiSensor: []config.MultiSensor{{
+				GeneralSensor: config.GeneralSensor{
+					ResultTopic: "tele/house",
+					Interval:    config.Interval(10 * time.Second),
+				},
+				Values: []config.MultiSensorValue{{
+					Name:        "Window",
+					Template:    "{{ value_json.window }}",
+					Unit:        "kB",
+					HaComponent: config.HaComponentBinarySensor,
+					HaBinary:    &config.HaBinary{On: "1", Off: "0"},
+					HaEntity:    binaryEntity,
+				}},
+			}}},
+			expectedTopic: "homeassistant/binary_sensor/D3V1C3_Window/config",
+			expectedPayload: `{
+				"name": "Window",
+				"uniq_id": "D3V1C3_Window",
+				"dev_cla": "door",
+				"dev": {"name": "Device", "ids": ["D3V1C3"], "mdl": "%s", "mf": "rainu", "sw": "mqtt-executor"},
+				"stat_t": "tele/house",
+				"value_template": "{{ value_json.window }}",
+				"pl_on": "1",
+				"pl_off": "0",
+				"exp_aft": 30
+			}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run("TestClient_BinarySensorDiscoveryConfig_"+tt.name, func(t *testing.T) {
+			client := newTestClient(&fakeClient{})
+
+			discoveryConfigs := client.generateDiscoveryConfigs(tt.topicConfig)
+
+			//the sensor-only fields (unit, state class, precision and force update) are dropped
+			assert.NotContains(t, discoveryConfigs, strings.Replace(tt.expectedTopic, "binary_sensor", "sensor", 1))
+			assert.JSONEq(t, fmt.Sprintf(tt.expectedPayload, runtime.GOOS), string(discoveryConfigs[tt.expectedTopic]))
+		})
+	}
+}
+
+func TestClient_SensorExpireAfter(t *testing.T) {
+	interval := func(d time.Duration) *config.Interval {
+		i := config.Interval(d)
+		return &i
+	}
+
+	tests := []struct {
+		name                string
+		sensor              config.GeneralSensor
+		expireAfter         *config.Interval
+		expectedExpireAfter interface{}
+	}{
+		{
+			name:                "interval",
+			sensor:              config.GeneralSensor{Interval: config.Interval(10 * time.Second)},
+			expectedExpireAfter: float64(30),
+		},
+		{
+			name: "interval with publish mode always",
+			sensor: config.GeneralSensor{
+				Interval:      config.Interval(10 * time.Second),
+				PublishMode:   config.PublishModeAlways,
+				ForceInterval: config.Interval(time.Minute),
+			},
+			expectedExpireAfter: float64(30),
+		},
+		{
+			name: "force interval with publish mode on change",
+			sensor: config.GeneralSensor{
+				Interval:      config.Interval(10 * time.Second),
+				PublishMode:   config.PublishModeOnChange,
+				ForceInterval: config.Interval(time.Minute),
+			},
+			expectedExpireAfter: float64(180),
+		},
+		{
+			name: "force interval with publish mode deadband",
+			sensor: config.GeneralSensor{
+				Interval:      config.Interval(10 * time.Second),
+				PublishMode:   config.PublishModeDeadband,
+				ForceInterval: config.Interval(2 * time.Minute),
+			},
+			expectedExpireAfter: float64(360),
+		},
+		{
+			name: "schedule",
+			sensor: config.GeneralSensor{
+				Interval: config.Interval(10 * time.Second),
+				Schedule: &config.Schedule{Expression: "*/5 * * * *"},
+			},
+		},
+		{
+			name:                "explicit",
+			sensor:              config.GeneralSensor{Schedule: &config.Schedule{Expression: "*/5 * * * *"}},
+			expireAfter:         interval(5 * time.Minute),
+			expectedExpireAfter: float64(300),
+		},
+	}
+	for _, tt := range tests {
+		t.Run("TestClient_SensorExpireAfter_"+tt.name, func(t *testing.T) {
+			client := newTestClient(&fakeClient{})
+
+			sensor := testSensor("load", "")
+			sensor.Interval = tt.sensor.Interval
+			sensor.PublishMode = tt.sensor.PublishMode
+			sensor.ForceInterval = tt.sensor.ForceInterval
+			sensor.Schedule = tt.sensor.Schedule
+			sensor.HaEntity.ExpireAfter = tt.expireAfter
+
+			discoveryConfigs := client.generateDiscoveryConfigs(config.TopicConfigurations{
+				Sensor: []config.Sensor{sensor},
+			})
+
+			discoveryConfig := map[string]interface{}{}
+			assert.NoError(t, json.Unmarshal(discoveryConfigs["homeassistant/sensor/D3V1C3_load/config"], &discoveryConfig))
+			assert.Equal(t, tt.expectedExpireAfter, discoveryConfig["exp_aft"])
+		})
+	}
+}
+
+func TestClient_TriggerSensorEntityCategory(t *testing.T) {
+	tests := []struct {
+		name             string
+		entityCategory   string
+		expectedCategory interface{}
+	}{
+		{name: "none"},
+		{name: "config", entityCategory: config.HaEntityCategoryConfig, expectedCategory: config.HaEntityCategoryDiagnostic},
+		{name: "diagnostic", entityCategory: config.HaEntityCategoryDiagnostic, expectedCategory: config.HaEntityCategoryDiagnostic},
+	}
+	for _, tt := range tests {
+		t.Run("TestClient_TriggerSensorEntityCategory_"+tt.name, func(t *testing.T) {
+			client := newTestClient(&fakeClient{})
+
+			discoveryConfigs := client.generateDiscoveryConfigs(config.TopicConfigurations{
+				Trigger: []config.Trigger{{
+					Name:     "Backup",
+					Topic:    "cmnd/backup",
+					Command:  config.Command{Name: "/bin/true"},
+					HaEntity: config.HaEntity{EntityCategory: tt.entityCategory},
+				}},
+			})
+
+			//the trigger entity itself keeps its category
+			triggerConfig := map[string]interface{}{}
+			assert.NoError(t, json.Unmarshal(discoveryConfigs["homeassistant/switch/D3V1C3/Backup/config"], &triggerConfig))
+			if tt.entityCategory == "" {
+				assert.NotContains(t, triggerConfig, "ent_cat")
+			} else {
+				assert.Equal(t, tt.entityCategory, triggerConfig["ent_cat"])
+			}
+
+			//the result and state sensors can not be a "config" entity
+			for _, suffix := range []string{"result", "state"} {
+				sensorConfig := map[string]interface{}{}
+				assert.NoError(t, json.Unmarshal(discoveryConfigs["homeassistant/sensor/D3V1C3_Backup/"+suffix+"/config"], &sensorConfig))
+				assert.Equal(t, tt.expectedCategory, sensorConfig["ent_cat"], suffix)
+			}
+		})
+	}
+}
+
+func TestClient_PublishDiscoveryConfig_Manifest(t *testing.T) {
+	defer func(timeout time.Duration) { manifestTimeout = timeout }(manifestTimeout)
+	manifestTimeout = 10 * time.Millisecond
+
+	tests := []struct {
+		name           string
+		manifest       []byte
+		expectedTopics map[string]bool
+	}{
+		{
+			name:     "manifest present",
+			manifest: []byte(`["homeassistant/sensor/D3V1C3_current/config", "homeassistant/sensor/D3V1C3_stale/config"]`),
+			expectedTopics: map[string]bool{
+				"homeassistant/sensor/D3V1C3_current/config": false,
+				"homeassistant/sensor/D3V1C3_stale/config":   true,
+			},
+		},
+		{
+			name: "manifest missing",
+			expectedTopics: map[string]bool{
+				"homeassistant/sensor/D3V1C3_current/config": false,
+			},
+		},
+		{
+			name:     "manifest invalid",
+			manifest: []byte(`{"homeassistant/sensor/D3V1C3_stale/config"`),
+			expectedTopics: map[string]bool{
+				"homeassistant/sensor/D3V1C3_current/config": false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run("TestClient_PublishDiscoveryConfig_Manifest_"+tt.name, func(t *testing.T) {
+			mqttClient := &fakeClient{}
+			if tt.manifest != nil {
+				mqttClient.retained = map[string][]byte{"homeassistant/mqtt-executor/D3V1C3/manifest": tt.manifest}
+			}
+			client := newTestClient(mqttClient)
+
+			client.PublishDiscoveryConfig(config.TopicConfigurations{
+				Sensor: []config.Sensor{testSensor("current", "kB")},
+			})
+
+			assert.Equal(t, tt.expectedTopics, mqttClient.topics())
+			assert.JSONEq(t, `["homeassistant/sensor/D3V1C3_current/config"]`,
+				string(mqttClient.retained["homeassistant/mqtt-executor/D3V1C3/manifest"]))
+		})
+	}
+}
+
+func TestClient_RemoveDiscoveryConfig_Manifest(t *testing.T) {
+	defer func(timeout time.Duration) { manifestTimeout = timeout }(manifestTimeout)
+	manifestTimeout = 10 * time.Millisecond
+
+	tests := []struct {
+		name           string
+		manifest       []byte
+		expectedTopics map[string]bool
+	}{
+		{
+			name:     "manifest present",
+			manifest: []byte(`["homeassistant/sensor/D3V1C3_stale/config"]`),
+			expectedTopics: map[string]bool{
+				"homeassistant/sensor/D3V1C3_current/config": true,
+				"homeassistant/sensor/D3V1C3_stale/config":   true,
+			},
+		},
+		{
+			name: "manifest missing",
+			expectedTopics: map[string]bool{
+				"homeassistant/sensor/D3V1C3_current/config": true,
+			},
+		},
+		{
+			name:     "manifest invalid",
+			manifest: []byte(`{"homeassistant/sensor/D3V1C3_stale/config"`),
+			expectedTopics: map[string]bool{
+				"homeassistant/sensor/D3V1C3_current/config": true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run("TestClient_RemoveDiscoveryConfig_Manifest_"+tt.name, func(t *testing.T) {
+			mqttClient := &fakeClient{}
+			if tt.manifest != nil {
+				mqttClient.retained = map[string][]byte{"homeassistant/mqtt-executor/D3V1C3/manifest": tt.manifest}
+			}
+			client := newTestClient(mqttClient)
+
+			client.RemoveDiscoveryConfig(config.TopicConfigurations{
+				Sensor: []config.Sensor{testSensor("current", "kB")},
+			})
+
+			assert.Equal(t, tt.expectedTopics, mqttClient.topics())
+			assert.NotContains(t, mqttClient.retained, "homeassistant/mqtt-executor/D3V1C3/manifest")
+		})
+	}
+}
+
+// blockingClient delays the delivery of the (retained) manifest
+type blockingClient struct {
+	*fakeClient
+	release chan bool
+}
+
+func (b *blockingClient) Subscribe(topic string, qos byte, handler mqtt.MessageHandler) mqtt.Token {
+	<-b.release
+	return b.fakeClient.Subscribe(topic, qos, handler)
+}
+
+func TestClient_PublishDiscoveryConfig_NotLockedWhileLoadingManifest(t *testing.T) {
+	defer func(timeout time.Duration) { manifestTimeout = timeout }(manifestTimeout)
+	manifestTimeout = 10 * time.Millisecond
+
+	mqttClient := &blockingClient{fakeClient: &fakeClient{}, release: make(chan bool)}
+	client := newTestClient(mqttClient.fakeClient)
+	client.MqttClient = mqttClient
+
+	done := make(chan bool)
+	go func() {
+		client.PublishDiscoveryConfig(config.TopicConfigurations{})
+		close(done)
+	}()
+
+	republished := make(chan bool)
+	go func() {
+		client.RepublishDiscoveryConfig()
+		close(republished)
+	}()
+
+	select {
+	case <-republished:
+	case <-time.After(time.Second):
+		assert.Fail(t, "the republishing is blocked while loading the manifest")
+	}
+
+	close(mqttClient.release)
+	<-done
+}
+
+func TestClient_SubscribeStatus(t *testing.T) {
+	mqttClient := &fakeClient{retained: map[string][]byte{
+		"homeassistant/mqtt-executor/D3V1C3/manifest": []byte(`[]`),
+	}}
+	client := newTestClient(mqttClient)
+	client.StatusTopic = "homeassistant/status"
+
+	client.PublishDiscoveryConfig(config.TopicConfigurations{
+		Sensor: []config.Sensor{testSensor("load", "")},
+	})
+	mqttClient.reset()
+
+	onlineCalls := make(chan bool, 10)
+	client.SubscribeStatus(func() {
+		onlineCalls <- true
+	})
+
+	//other payloads than the birth message will be ignored
+	mqttClient.receive("homeassistant/status", "offline")
+	select {
+	case <-onlineCalls:
+		assert.Fail(t, "the callback must not be called for offline")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Empty(t, mqttClient.topics())
+
+	//home assistant is (back) online -> republish all discovery configs
+	mqttClient.receive("homeassistant/status", " online\n")
+	select {
+	case <-onlineCalls:
+	case <-time.After(time.Second):
+		assert.Fail(t, "the callback was not called")
+	}
+	assert.Equal(t, map[string]bool{
+		"homeassistant/sensor/D3V1C3_load/config": false,
+	}, mqttClient.topics())
+
+	//without status topic nothing will be subscribed
+	mqttClient = &fakeClient{}
+	newTestClient(mqttClient).SubscribeStatus(func() {})
+	assert.Empty(t, mqttClient.handlers)
+}
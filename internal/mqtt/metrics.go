@@ -0,0 +1,80 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rainu/mqtt-executor/internal/cmd"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"sync"
+	"time"
+)
+
+// MetricsWorker publishes the metrics of the executor's worker pool periodically
+type MetricsWorker struct {
+	waitGroup  sync.WaitGroup
+	cancelFunc context.CancelFunc
+	publishQOS byte
+
+	Executor   *cmd.CommandExecutor
+	MqttClient Client
+}
+
+func (m *MetricsWorker) Initialise(publishQOS byte, metricsConfig config.Metrics) {
+	m.publishQOS = publishQOS
+
+	//generate a context so that we can cancel it later (see Close func)
+	var ctx context.Context
+	ctx, m.cancelFunc = context.WithCancel(context.Background())
+
+	m.waitGroup.Add(1)
+	go m.runMetrics(ctx, metricsConfig)
+}
+
+func (m *MetricsWorker) runMetrics(ctx context.Context, metricsConfig config.Metrics) {
+	defer m.waitGroup.Done()
+
+	ticker := time.NewTicker(time.Duration(metricsConfig.Interval))
+	defer ticker.Stop()
+
+	for {
+		m.publishMetrics(metricsConfig.Topic)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *MetricsWorker) publishMetrics(topic string) {
+	payload, err := json.Marshal(m.Executor.Metrics())
+	if err != nil {
+		//the "marshalling" is relatively safe - it should never appear at runtime
+		panic(err)
+	}
+
+	m.MqttClient.Publish(topic, m.publishQOS, false, payload)
+}
+
+func (m *MetricsWorker) Close(timeout time.Duration) error {
+	if m.cancelFunc != nil {
+		//close the context to stop publishing
+		m.cancelFunc()
+	}
+
+	wgChan := make(chan bool)
+	go func() {
+		m.waitGroup.Wait()
+		wgChan <- true
+	}()
+
+	//wait for WaitGroup or Timeout
+	select {
+	case <-wgChan:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("timeout exceeded")
+	}
+}
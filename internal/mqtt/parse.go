@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// parseOutput transforms the given command output as described in the parse configuration
+func parseOutput(parse config.Parse, output []byte) ([]byte, error) {
+	value := string(output)
+
+	if parse.JsonPath != "" {
+		var data interface{}
+		decoder := json.NewDecoder(bytes.NewReader(output))
+		decoder.UseNumber()
+		if err := decoder.Decode(&data); err != nil {
+			return nil, fmt.Errorf("invalid json: %w", err)
+		}
+
+		resolved, err := resolveJsonPath(data, parse.JsonPath)
+		if err != nil {
+			return nil, err
+		}
+		value = stringify(resolved)
+	}
+
+	if parse.Key != "" {
+		var err error
+		if value, err = lookupKeyValue(value, parse.Key, parse.Separator); err != nil {
+			return nil, err
+		}
+	}
+
+	if parse.Regex != nil {
+		match := parse.Regex.FindStringSubmatch(value)
+		if match == nil {
+			return nil, errors.New("regex does not match")
+		}
+
+		//the first capture group (if available) or the whole match
+		value = match[0]
+		if len(match) > 1 {
+			value = match[1]
+		}
+	}
+
+	if parse.Number || parse.Scale != nil || parse.Precision != nil {
+		number, err := extractNumber(value)
+		if err != nil {
+			return nil, err
+		}
+		if parse.Scale != nil {
+			number *= *parse.Scale
+		}
+
+		precision := -1
+		if parse.Precision != nil {
+			precision = *parse.Precision
+		}
+		value = strconv.FormatFloat(number, 'f', precision, 64)
+	}
+
+	return []byte(strings.TrimSpace(value)), nil
+}
+
+// resolveJsonPath resolves a dot-separated path (ex. "disks.0.free") inside the given json data
+func resolveJsonPath(data interface{}, path string) (interface{}, error) {
+	current := data
+	for _, segment := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, exists := node[segment]
+			if !exists {
+				return nil, fmt.Errorf("json path not found: %s", path)
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, fmt.Errorf("json path not found: %s", path)
+			}
+			current = node[index]
+		default:
+			return nil, fmt.Errorf("json path not found: %s", path)
+		}
+	}
+	return current, nil
+}
+
+// lookupKeyValue searches the line which begins with "<key><separator>" and returns its (trimmed) value
+func lookupKeyValue(content, key, separator string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), separator, 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == key {
+			return strings.TrimSpace(parts[1]), nil
+		}
+	}
+	return "", fmt.Errorf("key not found: %s", key)
+}
+
+var numberRegex = regexp.MustCompile(`[-+]?[0-9]*\.?[0-9]+([eE][-+]?[0-9]+)?`)
+
+func extractNumber(value string) (float64, error) {
+	match := numberRegex.FindString(value)
+	if match == "" {
+		return 0, errors.New("no number found")
+	}
+	return strconv.ParseFloat(match, 64)
+}
@@ -0,0 +1,99 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseOutput(t *testing.T) {
+	meminfo := "MemTotal:       16318480 kB\nMemFree:         1234567 kB\n"
+
+	tests := []struct {
+		name          string
+		parse         string
+		output        string
+		expected      string
+		expectedError string
+	}{
+		{
+			name:     "nothing",
+			parse:    `{}`,
+			output:   " 42\n",
+			expected: "42",
+		},
+		{
+			name:     "regex with capture group",
+			parse:    `{"regex": "temp=([0-9.]+)'C"}`,
+			output:   "temp=42.8'C",
+			expected: "42.8",
+		},
+		{
+			name:     "regex without capture group",
+			parse:    `{"regex": "[0-9]+"}`,
+			output:   "up 42 days",
+			expected: "42",
+		},
+		{
+			name:          "regex no match",
+			parse:         `{"regex": "[0-9]+"}`,
+			output:        "up",
+			expectedError: "regex does not match",
+		},
+		{
+			name:     "json path",
+			parse:    `{"json_path": "disks.1.free"}`,
+			output:   `{"disks": [{"free": 1}, {"free": 2.5}]}`,
+			expected: "2.5",
+		},
+		{
+			name:          "json path not found",
+			parse:         `{"json_path": "disks.2.free"}`,
+			output:        `{"disks": [{"free": 1}, {"free": 2.5}]}`,
+			expectedError: "json path not found: disks.2.free",
+		},
+		{
+			name:     "key value",
+			parse:    `{"key": "MemFree", "separator": ":"}`,
+			output:   meminfo,
+			expected: "1234567 kB",
+		},
+		{
+			name:     "key value to MB",
+			parse:    `{"key": "MemFree", "separator": ":", "scale": 0.001, "precision": 1}`,
+			output:   meminfo,
+			expected: "1234.6",
+		},
+		{
+			name:     "number",
+			parse:    `{"number": true}`,
+			output:   "load: -1.5e2 units",
+			expected: "-150",
+		},
+		{
+			name:          "no number",
+			parse:         `{"number": true}`,
+			output:        "nothing",
+			expectedError: "no number found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestParseOutput_"+tt.name, func(t *testing.T) {
+			parse := config.Parse{}
+			if err := json.Unmarshal([]byte(tt.parse), &parse); err != nil {
+				panic(err)
+			}
+
+			result, err := parseOutput(parse, []byte(tt.output))
+			if tt.expectedError != "" {
+				assert.Error(t, err)
+				assert.Equal(t, tt.expectedError, err.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, string(result))
+			}
+		})
+	}
+}
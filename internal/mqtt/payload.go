@@ -0,0 +1,236 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rainu/mqtt-executor/internal/cmd"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	EnvPayload       = "MQTT_EXECUTOR_PAYLOAD"
+	EnvPayloadPrefix = "MQTT_EXECUTOR_PAYLOAD_"
+	PayloadValueKey  = config.PayloadValueField
+)
+
+// triggerInput contains the (parsed) payload of an incoming trigger message
+type triggerInput struct {
+	raw    []byte
+	values map[string]string
+}
+
+func parsePayload(payloadConfig config.TriggerPayload, payload []byte) (triggerInput, error) {
+	input := triggerInput{
+		raw:    payload,
+		values: map[string]string{},
+	}
+
+	switch payloadConfig.Format {
+	case config.PayloadFormatJson:
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+
+		fields := map[string]interface{}{}
+		if err := decoder.Decode(&fields); err != nil {
+			return input, reject("invalid json payload: %s", err)
+		}
+		for key, value := range fields {
+			input.values[key] = stringify(value)
+		}
+	default:
+		input.values[PayloadValueKey] = strings.TrimSpace(string(payload))
+	}
+
+	return input, nil
+}
+
+func stringify(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return fmt.Sprintf("%t", v)
+	default:
+		//nested objects and arrays will be passed as (compact) json
+		raw, _ := json.Marshal(v)
+		return string(raw)
+	}
+}
+
+// rejectionError will be returned if a payload does not match the trigger's payload schema
+type rejectionError struct {
+	reason string
+}
+
+func (r *rejectionError) Error() string {
+	return r.reason
+}
+
+func reject(format string, args ...interface{}) error {
+	return &rejectionError{reason: fmt.Sprintf(format, args...)}
+}
+
+// payloadSchema is the prepared schema of a trigger's payload (see config.TriggerPayload)
+type payloadSchema struct {
+	fields map[string]config.PayloadField
+
+	//the anchored regex of each field: the complete value must match (not only a part of it)
+	fullMatches map[string]*regexp.Regexp
+
+	//the fields which are referenced by a placeholder of the command's arguments (they must be present)
+	referenced map[string]bool
+}
+
+// newPayloadSchema prepares the schema of the given trigger's payload (nil means that every input is allowed)
+func newPayloadSchema(trigger config.Trigger) *payloadSchema {
+	payloadConfig := trigger.Payload
+	if payloadConfig == nil || payloadConfig.Schema == nil {
+		return nil
+	}
+
+	schema := &payloadSchema{
+		fields:      payloadConfig.Schema,
+		fullMatches: map[string]*regexp.Regexp{},
+		referenced:  map[string]bool{},
+	}
+	for name, field := range payloadConfig.Schema {
+		if field.Regex != nil && field.Regex.Regexp != nil {
+			//the expression itself was already compiled successfully -> the group around it is safe
+			schema.fullMatches[name] = regexp.MustCompile("^(?:" + field.Regex.String() + ")$")
+		}
+	}
+	if payloadConfig.Mode == config.PayloadModeArguments {
+		for _, argument := range trigger.Command.Arguments {
+			for _, match := range placeholderRegex.FindAllStringSubmatch(argument, -1) {
+				schema.referenced[match[1]] = true
+			}
+		}
+	}
+	return schema
+}
+
+// validateInput checks the input against the given schema (nil means that every input is allowed)
+func validateInput(schema *payloadSchema, input triggerInput) error {
+	if schema == nil {
+		return nil
+	}
+
+	//ensure a stable order (the first violation will be reported)
+	names := make([]string, 0, len(input.values))
+	for name := range input.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, known := schema.fields[name]; !known {
+			return reject("unknown field: %s", name)
+		}
+	}
+
+	names = names[:0]
+	for name := range schema.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, present := input.values[name]
+		if !present {
+			//an absent field is only allowed if the command does not depend on it
+			if schema.fields[name].Required || schema.referenced[name] {
+				return reject("missing field: %s", name)
+			}
+			continue
+		}
+		if err := validateField(name, schema.fields[name], schema.fullMatches[name], value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateField(name string, field config.PayloadField, fullMatch *regexp.Regexp, value string) error {
+	if value == "" && field.Required {
+		return reject("missing field: %s", name)
+	}
+
+	//an empty value (ex. "" or null) must fulfill the restrictions too
+
+	if len(field.Enum) > 0 {
+		allowed := false
+		for _, enum := range field.Enum {
+			allowed = allowed || enum == value
+		}
+		if !allowed {
+			return reject("invalid value of field %s: not one of %s", name, strings.Join(field.Enum, ", "))
+		}
+	}
+	if fullMatch != nil {
+		if !fullMatch.MatchString(value) {
+			return reject("invalid value of field %s: does not match %s", name, field.Regex.String())
+		}
+	}
+	if field.Min != nil || field.Max != nil {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return reject("invalid value of field %s: not a number", name)
+		}
+		if field.Min != nil && number < *field.Min {
+			return reject("invalid value of field %s: less than %v", name, *field.Min)
+		}
+		if field.Max != nil && number > *field.Max {
+			return reject("invalid value of field %s: greater than %v", name, *field.Max)
+		}
+	}
+
+	return nil
+}
+
+var placeholderRegex = regexp.MustCompile(`\$\{([a-zA-Z0-9_]+)\}`)
+
+// applyInput transfers the trigger input into the execution (depending on the payload mode)
+func applyInput(execution *cmd.Execution, payloadConfig config.TriggerPayload, input triggerInput) error {
+	switch payloadConfig.Mode {
+	case config.PayloadModeArguments:
+		arguments := make([]string, len(execution.Arguments))
+		for i, argument := range execution.Arguments {
+			arguments[i] = placeholderRegex.ReplaceAllStringFunc(argument, func(placeholder string) string {
+				//placeholders without value (ex. simple START message) will be empty - never the placeholder itself
+				return input.values[placeholderRegex.FindStringSubmatch(placeholder)[1]]
+			})
+		}
+		execution.Arguments = arguments
+	case config.PayloadModeEnv:
+		if input.raw == nil {
+			//no input available (ex. simple START message)
+			return nil
+		}
+		execution.Environment = append(execution.Environment, fmt.Sprintf("%s=%s", EnvPayload, input.raw))
+		for key, value := range input.values {
+			execution.Environment = append(execution.Environment, fmt.Sprintf("%s%s=%s", EnvPayloadPrefix, envName(key), value))
+		}
+	case config.PayloadModeStdin:
+		execution.Stdin = input.raw
+	default:
+		return errors.New("unknown payload mode")
+	}
+
+	return nil
+}
+
+var envNameRegex = regexp.MustCompile(`[^A-Z0-9_]`)
+
+func envName(key string) string {
+	return envNameRegex.ReplaceAllString(strings.ToUpper(key), "_")
+}
@@ -0,0 +1,155 @@
+package mqtt
+
+import (
+	"github.com/rainu/mqtt-executor/internal/cmd"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+)
+
+func TestParsePayload(t *testing.T) {
+	tests := []struct {
+		name           string
+		format         string
+		payload        string
+		expectedValues map[string]string
+		expectedError  string
+	}{
+		{
+			name:           "text",
+			format:         config.PayloadFormatText,
+			payload:        " 42\n",
+			expectedValues: map[string]string{"value": "42"},
+		},
+		{
+			name:    "json",
+			format:  config.PayloadFormatJson,
+			payload: `{"volume": 42, "channel": "Master", "mute": false, "extra": {"a": 1}}`,
+			expectedValues: map[string]string{
+				"volume":  "42",
+				"channel": "Master",
+				"mute":    "false",
+				"extra":   `{"a":1}`,
+			},
+		},
+		{
+			name:          "invalid json",
+			format:        config.PayloadFormatJson,
+			payload:       `42`,
+			expectedError: "invalid json payload: json: cannot unmarshal number into Go value of type map[string]interface {}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestParsePayload_"+tt.name, func(t *testing.T) {
+			input, err := parsePayload(config.TriggerPayload{Format: tt.format}, []byte(tt.payload))
+			if tt.expectedError != "" {
+				assert.Error(t, err)
+				assert.Equal(t, tt.expectedError, err.Error())
+				assert.Equal(t, ResultRejected+";"+tt.expectedError, string(resultPayload(nil, cmd.Result{}, err)))
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectedValues, input.values)
+				assert.Equal(t, []byte(tt.payload), input.raw)
+			}
+		})
+	}
+}
+
+func TestApplyInput(t *testing.T) {
+	input := triggerInput{
+		raw:    []byte(`{"volume": 42}`),
+		values: map[string]string{"volume": "42", "left-channel": "on"},
+	}
+
+	execution := cmd.Execution{Arguments: []string{"set", "${volume}%", "${unknown}", "$volume"}}
+	assert.NoError(t, applyInput(&execution, config.TriggerPayload{Mode: config.PayloadModeArguments}, input))
+	assert.Equal(t, []string{"set", "42%", "", "$volume"}, execution.Arguments)
+
+	//without input (ex. simple START message) the placeholders will be empty
+	execution = cmd.Execution{Arguments: []string{"set", "${volume}%"}}
+	assert.NoError(t, applyInput(&execution, config.TriggerPayload{Mode: config.PayloadModeArguments}, triggerInput{}))
+	assert.Equal(t, []string{"set", "%"}, execution.Arguments)
+
+	execution = cmd.Execution{}
+	assert.NoError(t, applyInput(&execution, config.TriggerPayload{Mode: config.PayloadModeEnv}, triggerInput{}))
+	assert.Empty(t, execution.Environment)
+
+	execution = cmd.Execution{}
+	assert.NoError(t, applyInput(&execution, config.TriggerPayload{Mode: config.PayloadModeEnv}, input))
+	assert.ElementsMatch(t, []string{
+		`MQTT_EXECUTOR_PAYLOAD={"volume": 42}`,
+		`MQTT_EXECUTOR_PAYLOAD_VOLUME=42`,
+		`MQTT_EXECUTOR_PAYLOAD_LEFT_CHANNEL=on`,
+	}, execution.Environment)
+
+	execution = cmd.Execution{}
+	assert.NoError(t, applyInput(&execution, config.TriggerPayload{Mode: config.PayloadModeStdin}, input))
+	assert.Equal(t, input.raw, execution.Stdin)
+}
+
+func TestValidateInput(t *testing.T) {
+	min, max := 0.0, 100.0
+	schema := newPayloadSchema(config.Trigger{
+		Payload: &config.TriggerPayload{
+			Schema: map[string]config.PayloadField{
+				"channel": {Required: true, Enum: []string{"Master", "PCM"}},
+				"volume":  {Min: &min, Max: &max},
+				"name":    {Regex: &config.Regexp{Regexp: regexp.MustCompile(`[a-z]+|[0-9]+`)}},
+				"mode":    {Enum: []string{"low", "high"}},
+			},
+		},
+	})
+
+	tests := []struct {
+		name          string
+		values        map[string]string
+		expectedError string
+	}{
+		{name: "valid", values: map[string]string{"channel": "Master", "volume": "42", "name": "abc", "mode": "low"}},
+		{name: "optional fields", values: map[string]string{"channel": "PCM"}},
+		{name: "empty required field", values: map[string]string{"channel": ""}, expectedError: "missing field: channel"},
+		{name: "empty enum value", values: map[string]string{"channel": "PCM", "mode": ""}, expectedError: "invalid value of field mode: not one of low, high"},
+		{name: "empty regex value", values: map[string]string{"channel": "PCM", "name": ""}, expectedError: "invalid value of field name: does not match [a-z]+|[0-9]+"},
+		{name: "empty number", values: map[string]string{"channel": "PCM", "volume": ""}, expectedError: "invalid value of field volume: not a number"},
+		{name: "unknown field", values: map[string]string{"channel": "PCM", "rm": "-rf"}, expectedError: "unknown field: rm"},
+		{name: "missing field", values: map[string]string{"volume": "42"}, expectedError: "missing field: channel"},
+		{name: "enum", values: map[string]string{"channel": "Line"}, expectedError: "invalid value of field channel: not one of Master, PCM"},
+		{name: "regex alternative", values: map[string]string{"channel": "PCM", "name": "123"}},
+		{name: "regex", values: map[string]string{"channel": "PCM", "name": "abc;reboot"}, expectedError: "invalid value of field name: does not match [a-z]+|[0-9]+"},
+		{name: "regex partial alternative", values: map[string]string{"channel": "PCM", "name": "abc123"}, expectedError: "invalid value of field name: does not match [a-z]+|[0-9]+"},
+		{name: "not a number", values: map[string]string{"channel": "PCM", "volume": "loud"}, expectedError: "invalid value of field volume: not a number"},
+		{name: "NaN", values: map[string]string{"channel": "PCM", "volume": "NaN"}, expectedError: "invalid value of field volume: not a number"},
+		{name: "infinity", values: map[string]string{"channel": "PCM", "volume": "-Inf"}, expectedError: "invalid value of field volume: not a number"},
+		{name: "min", values: map[string]string{"channel": "PCM", "volume": "-1"}, expectedError: "invalid value of field volume: less than 0"},
+		{name: "max", values: map[string]string{"channel": "PCM", "volume": "101"}, expectedError: "invalid value of field volume: greater than 100"},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestValidateInput_"+tt.name, func(t *testing.T) {
+			err := validateInput(schema, triggerInput{values: tt.values})
+			if tt.expectedError != "" {
+				assert.Error(t, err)
+				assert.Equal(t, tt.expectedError, err.Error())
+				assert.Equal(t, ResultRejected+";"+tt.expectedError, string(resultPayload(nil, cmd.Result{}, err)))
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	//a field which is referenced by a placeholder of the arguments is required
+	schema = newPayloadSchema(config.Trigger{
+		Command: config.Command{Name: "/usr/bin/amixer", Arguments: []string{"set", "${channel}"}},
+		Payload: &config.TriggerPayload{
+			Mode:   config.PayloadModeArguments,
+			Schema: map[string]config.PayloadField{"channel": {Enum: []string{"Master", "PCM"}}},
+		},
+	})
+	assert.NoError(t, validateInput(schema, triggerInput{values: map[string]string{"channel": "PCM"}}))
+	assert.EqualError(t, validateInput(schema, triggerInput{}), "missing field: channel")
+
+	assert.NoError(t, validateInput(nil, triggerInput{values: map[string]string{"any": "thing"}}))
+	assert.Nil(t, newPayloadSchema(config.Trigger{Payload: &config.TriggerPayload{Format: config.PayloadFormatText}}))
+}
@@ -0,0 +1,81 @@
+package mqtt
+
+import (
+	"bytes"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// publishFilter decides if a sensor value should be published (depending on the sensor's publish mode)
+type publishFilter struct {
+	mode          string
+	deadband      config.Deadband
+	forceInterval time.Duration
+
+	published     bool
+	lastPublished time.Time
+	lastPayload   []byte
+}
+
+func newPublishFilter(sensorConf config.GeneralSensor) *publishFilter {
+	filter := &publishFilter{
+		mode:          sensorConf.PublishMode,
+		forceInterval: time.Duration(sensorConf.ForceInterval),
+	}
+	if sensorConf.Deadband != nil {
+		filter.deadband = *sensorConf.Deadband
+	}
+	return filter
+}
+
+// ShouldPublish checks if the given payload should be published. If so, the payload is remembered as last published one.
+func (p *publishFilter) ShouldPublish(payload []byte, now time.Time) bool {
+	if !p.shouldPublish(payload, now) {
+		return false
+	}
+
+	p.published = true
+	p.lastPublished = now
+	p.lastPayload = append([]byte{}, payload...)
+	return true
+}
+
+func (p *publishFilter) shouldPublish(payload []byte, now time.Time) bool {
+	if p.mode == "" || p.mode == config.PublishModeAlways || !p.published {
+		return true
+	}
+	if p.forceInterval > 0 && now.Sub(p.lastPublished) >= p.forceInterval {
+		return true
+	}
+
+	if p.mode == config.PublishModeDeadband {
+		last, lastErr := parseNumber(p.lastPayload)
+		current, currentErr := parseNumber(payload)
+
+		//non-numeric values are handled like in on_change mode
+		if lastErr == nil && currentErr == nil {
+			return p.exceedsDeadband(last, current)
+		}
+	}
+
+	return !bytes.Equal(p.lastPayload, payload)
+}
+
+func (p *publishFilter) exceedsDeadband(last, current float64) bool {
+	diff := math.Abs(current - last)
+
+	if p.deadband.Absolute > 0 && diff >= p.deadband.Absolute {
+		return true
+	}
+	if p.deadband.Percent > 0 && diff >= math.Abs(last)*p.deadband.Percent/100 {
+		return true
+	}
+	return false
+}
+
+func parseNumber(payload []byte) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+}
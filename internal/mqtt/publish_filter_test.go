@@ -0,0 +1,67 @@
+package mqtt
+
+import (
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPublishFilter(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	type step struct {
+		payload  string
+		offset   time.Duration
+		expected bool
+	}
+
+	tests := []struct {
+		name   string
+		sensor config.GeneralSensor
+		steps  []step
+	}{
+		{
+			name:   "always",
+			sensor: config.GeneralSensor{},
+			steps:  []step{{"1", 0, true}, {"1", 0, true}},
+		},
+		{
+			name:   "on change",
+			sensor: config.GeneralSensor{PublishMode: config.PublishModeOnChange},
+			steps:  []step{{"1", 0, true}, {"1", 0, false}, {"2", 0, true}, {"1", 0, true}},
+		},
+		{
+			name: "on change with force interval",
+			sensor: config.GeneralSensor{
+				PublishMode:   config.PublishModeOnChange,
+				ForceInterval: config.Interval(time.Minute),
+			},
+			steps: []step{{"1", 0, true}, {"1", 59 * time.Second, false}, {"1", time.Minute, true}, {"1", time.Minute, false}},
+		},
+		{
+			name: "absolute deadband",
+			sensor: config.GeneralSensor{
+				PublishMode: config.PublishModeDeadband,
+				Deadband:    &config.Deadband{Absolute: 0.5},
+			},
+			steps: []step{{"10", 0, true}, {"10.4", 0, false}, {"9.6", 0, false}, {"10.5", 0, true}, {"<FAILED>", 0, true}},
+		},
+		{
+			name: "percent deadband",
+			sensor: config.GeneralSensor{
+				PublishMode: config.PublishModeDeadband,
+				Deadband:    &config.Deadband{Percent: 10},
+			},
+			steps: []step{{"200", 0, true}, {"219", 0, false}, {"180", 0, true}, {"170", 0, false}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestPublishFilter_"+tt.name, func(t *testing.T) {
+			filter := newPublishFilter(tt.sensor)
+			for i, s := range tt.steps {
+				assert.Equal(t, s.expected, filter.ShouldPublish([]byte(s.payload), start.Add(s.offset)), "step #%d", i)
+			}
+		})
+	}
+}
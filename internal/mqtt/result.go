@@ -0,0 +1,125 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rainu/mqtt-executor/internal/cmd"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"strconv"
+	"time"
+)
+
+const (
+	TopicSuffixExitCode = "EXIT_CODE"
+	TopicSuffixStdout   = "STDOUT"
+	TopicSuffixStderr   = "STDERR"
+
+	StatusSuccess     = "SUCCESS"
+	StatusFailed      = "FAILED"
+	StatusInterrupted = "INTERRUPTED"
+	StatusTimeout     = "TIMEOUT"
+	StatusRejected    = "REJECTED"
+)
+
+type executionResult struct {
+	ExecutionId string    `json:"execution_id,omitempty"`
+	Status      string    `json:"status"`
+	ExitCode    int       `json:"exit_code"`
+	Stdout      string    `json:"stdout"`
+	Stderr      string    `json:"stderr"`
+	StartedAt   time.Time `json:"started_at"`
+	DurationMs  int64     `json:"duration_ms"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func newExecutionResult(result cmd.Result, execErr error) executionResult {
+	r := executionResult{
+		Status:     executionStatus(execErr),
+		ExitCode:   result.ExitCode,
+		Stdout:     string(result.Stdout),
+		Stderr:     string(result.Stderr),
+		StartedAt:  result.StartedAt,
+		DurationMs: result.Duration.Milliseconds(),
+	}
+	if execErr != nil {
+		r.Error = execErr.Error()
+	}
+	return r
+}
+
+func executionStatus(execErr error) string {
+	switch execErr {
+	case nil:
+		return StatusSuccess
+	case context.Canceled:
+		return StatusInterrupted
+	case context.DeadlineExceeded:
+		return StatusTimeout
+	default:
+		var rejection *rejectionError
+		if errors.As(execErr, &rejection) {
+			return StatusRejected
+		}
+		return StatusFailed
+	}
+}
+
+// resultPayload generates the payload for the given result depending on the configured result format
+func resultPayload(resultConfig *config.Result, result cmd.Result, execErr error) []byte {
+	return resultPayloadWithId(resultConfig, "", result, execErr)
+}
+
+// resultPayloadWithId generates the result payload which contains the given execution id (if given). The raw
+// payload will be prefixed with the id: <ID>;<RESULT>
+func resultPayloadWithId(resultConfig *config.Result, executionId string, result cmd.Result, execErr error) []byte {
+	if resultConfig != nil && resultConfig.Format == config.ResultFormatJson {
+		jsonResult := newExecutionResult(result, execErr)
+		jsonResult.ExecutionId = executionId
+
+		payload, err := json.Marshal(jsonResult)
+		if err != nil {
+			//the "marshalling" is relatively safe - it should never appear at runtime
+			panic(err)
+		}
+		return payload
+	}
+
+	payload := rawResultPayload(result, execErr)
+	if executionId != "" {
+		payload = append([]byte(executionId+";"), payload...)
+	}
+	return payload
+}
+
+func rawResultPayload(result cmd.Result, execErr error) []byte {
+	switch executionStatus(execErr) {
+	case StatusInterrupted:
+		//this can happen if a STOPPED-Message was incoming or the application is shutting down
+		return []byte(ResultInterrupted)
+	case StatusTimeout:
+		//the command runs longer than the configured timeout
+		return []byte(ResultTimeout)
+	case StatusRejected:
+		//the payload does not match the payload schema
+		return []byte(ResultRejected + ";" + execErr.Error())
+	case StatusFailed:
+		//program execution failed (status code != 0)
+		return []byte(ResultFailed + ";" + execErr.Error())
+	}
+
+	//the program's output (stdout & stderr)
+	return result.Output
+}
+
+// publishResultSubTopics publishes the parts of the result to dedicated topics (if configured)
+func publishResultSubTopics(client Client, parentTopic string, qos byte, retained bool, resultConfig *config.Result, result cmd.Result) {
+	if resultConfig == nil || !resultConfig.SubTopics {
+		return
+	}
+
+	client.Publish(fmt.Sprintf("%s/%s", parentTopic, TopicSuffixExitCode), qos, retained, strconv.Itoa(result.ExitCode))
+	client.Publish(fmt.Sprintf("%s/%s", parentTopic, TopicSuffixStdout), qos, retained, result.Stdout)
+	client.Publish(fmt.Sprintf("%s/%s", parentTopic, TopicSuffixStderr), qos, retained, result.Stderr)
+}
@@ -0,0 +1,54 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"github.com/rainu/mqtt-executor/internal/cmd"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestResultPayload(t *testing.T) {
+	result := cmd.Result{
+		Output:    []byte("out\nerr"),
+		Stdout:    []byte("out"),
+		Stderr:    []byte("err"),
+		StartedAt: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:  1500 * time.Millisecond,
+	}
+	jsonFormat := &config.Result{Format: config.ResultFormatJson}
+
+	tests := []struct {
+		name     string
+		config   *config.Result
+		exitCode int
+		err      error
+		expected string
+	}{
+		{name: "raw success", expected: "out\nerr"},
+		{name: "raw failed", exitCode: 1, err: errors.New("exit status 1"), expected: "<FAILED>;exit status 1"},
+		{name: "raw interrupted", err: context.Canceled, expected: "<INTERRUPTED>"},
+		{name: "raw timeout", config: &config.Result{Format: config.ResultFormatRaw}, err: context.DeadlineExceeded, expected: "<TIMEOUT>"},
+		{
+			name:     "json success",
+			config:   jsonFormat,
+			expected: `{"status":"SUCCESS","exit_code":0,"stdout":"out","stderr":"err","started_at":"2020-01-02T03:04:05Z","duration_ms":1500}`,
+		},
+		{
+			name:     "json failed",
+			config:   jsonFormat,
+			exitCode: 1,
+			err:      errors.New("exit status 1"),
+			expected: `{"status":"FAILED","exit_code":1,"stdout":"out","stderr":"err","started_at":"2020-01-02T03:04:05Z","duration_ms":1500,"error":"exit status 1"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("TestResultPayload_"+tt.name, func(t *testing.T) {
+			result.ExitCode = tt.exitCode
+			assert.Equal(t, tt.expected, string(resultPayload(tt.config, result, tt.err)))
+		})
+	}
+}
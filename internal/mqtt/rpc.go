@@ -0,0 +1,86 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"strings"
+)
+
+// rpcEnvelope is the json envelope of an incoming trigger message (rpc mode)
+type rpcEnvelope struct {
+	Id      json.RawMessage `json:"id"`
+	ReplyTo string          `json:"reply_to"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// rpcResponse is the json envelope of the result which will be published to the reply topic
+type rpcResponse struct {
+	Id     json.RawMessage `json:"id,omitempty"`
+	Result json.RawMessage `json:"result"`
+}
+
+// parseRpcEnvelope checks if the given payload is a rpc envelope (a json object with a reply topic). If so the
+// envelope and the inner payload are returned. A missing inner payload is the same as a START message.
+func parseRpcEnvelope(payload []byte) (rpcEnvelope, []byte, bool) {
+	var envelope rpcEnvelope
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&envelope); err != nil || envelope.ReplyTo == "" {
+		return envelope, nil, false
+	}
+
+	var inner []byte
+	var text string
+	switch {
+	case len(envelope.Payload) == 0 || string(envelope.Payload) == "null":
+		inner = []byte(PayloadStart)
+	case json.Unmarshal(envelope.Payload, &text) == nil:
+		inner = []byte(text)
+	default:
+		//objects (ex. for json payload format) will be passed as they are
+		inner = envelope.Payload
+	}
+
+	return envelope, inner, true
+}
+
+// checkReplyTopic checks if the reply topic of a rpc envelope is a valid topic (without wildcards) which starts with
+// the given prefix
+func checkReplyTopic(replyTo, prefix string) error {
+	if err := config.CheckTopicName(replyTo); err != nil {
+		return reject("invalid reply topic: %s", err)
+	}
+	if !strings.HasPrefix(replyTo, prefix) {
+		return reject("invalid reply topic: must start with %s", prefix)
+	}
+	return nil
+}
+
+// rpcResponsePayload wraps the given result payload into the rpc response envelope
+func rpcResponsePayload(id json.RawMessage, resultConfig *config.Result, result []byte) []byte {
+	response := rpcResponse{
+		Id:     id,
+		Result: result,
+	}
+	if resultConfig == nil || resultConfig.Format != config.ResultFormatJson {
+		//the raw result must be transferred as json string
+		response.Result = marshalUnescaped(string(result))
+	}
+
+	return marshalUnescaped(response)
+}
+
+// marshalUnescaped generates json without escaping html characters (like the brackets of <FAILED>)
+func marshalUnescaped(value interface{}) []byte {
+	buf := bytes.Buffer{}
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(value); err != nil {
+		//the "marshalling" is relatively safe - it should never appear at runtime
+		panic(err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
@@ -0,0 +1,101 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRpcEnvelope(t *testing.T) {
+	tests := []struct {
+		name             string
+		payload          string
+		expectedEnvelope bool
+		expectedId       string
+		expectedReplyTo  string
+		expectedPayload  string
+	}{
+		{
+			name:    "no json",
+			payload: "START",
+		},
+		{
+			name:    "json without reply topic",
+			payload: `{"id": 1, "payload": "START"}`,
+		},
+		{
+			name:             "without payload",
+			payload:          `{"id": 1, "reply_to": "my/reply"}`,
+			expectedEnvelope: true,
+			expectedId:       "1",
+			expectedReplyTo:  "my/reply",
+			expectedPayload:  "START",
+		},
+		{
+			name:             "text payload",
+			payload:          `{"id": "abc", "reply_to": "my/reply", "payload": "STOP"}`,
+			expectedEnvelope: true,
+			expectedId:       `"abc"`,
+			expectedReplyTo:  "my/reply",
+			expectedPayload:  "STOP",
+		},
+		{
+			name:             "json payload",
+			payload:          `{"reply_to": "my/reply", "payload": {"name": "world"}}`,
+			expectedEnvelope: true,
+			expectedReplyTo:  "my/reply",
+			expectedPayload:  `{"name": "world"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, payload, ok := parseRpcEnvelope([]byte(tt.payload))
+
+			assert.Equal(t, tt.expectedEnvelope, ok)
+			if ok {
+				assert.Equal(t, tt.expectedId, string(envelope.Id))
+				assert.Equal(t, tt.expectedReplyTo, envelope.ReplyTo)
+				assert.Equal(t, tt.expectedPayload, string(payload))
+			}
+		})
+	}
+}
+
+func TestCheckReplyTopic(t *testing.T) {
+	tests := []struct {
+		name          string
+		replyTo       string
+		prefix        string
+		expectedError string
+	}{
+		{name: "valid", replyTo: "my/reply"},
+		{name: "valid with prefix", replyTo: "reply/client1", prefix: "reply/"},
+		{name: "single level wildcard", replyTo: "my/+/reply", expectedError: "invalid reply topic: invalid character"},
+		{name: "multi level wildcard", replyTo: "my/#", expectedError: "invalid reply topic: invalid character"},
+		{name: "blank", replyTo: " ", expectedError: "invalid reply topic: must not be empty"},
+		{name: "wrong prefix", replyTo: "cmnd/reboot", prefix: "reply/", expectedError: "invalid reply topic: must start with reply/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkReplyTopic(tt.replyTo, tt.prefix)
+			if tt.expectedError != "" {
+				assert.Error(t, err)
+				assert.Equal(t, tt.expectedError, err.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRpcResponsePayload(t *testing.T) {
+	assert.Equal(t, `{"id":"abc","result":"hello\nworld"}`,
+		string(rpcResponsePayload(json.RawMessage(`"abc"`), nil, []byte("hello\nworld"))))
+
+	assert.Equal(t, `{"id":13,"result":{"status":"SUCCESS"}}`,
+		string(rpcResponsePayload(json.RawMessage(`13`), &config.Result{Format: config.ResultFormatJson}, []byte(`{"status":"SUCCESS"}`))))
+
+	assert.Equal(t, `{"result":"<FAILED>;invalid payload"}`,
+		string(rpcResponsePayload(nil, &config.Result{Format: config.ResultFormatRaw}, []byte("<FAILED>;invalid payload"))))
+}
@@ -0,0 +1,29 @@
+package mqtt
+
+import (
+	"context"
+	"github.com/robfig/cron/v3"
+	"time"
+)
+
+// runScheduled calls the given function at each scheduled time until the context is done
+func runScheduled(ctx context.Context, schedule cron.Schedule, fn func()) {
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			//the schedule will never be activated again
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+
+		//wait until next execution time or shutdown
+		select {
+		case <-timer.C:
+			fn()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// everySecond returns a schedule which will be activated at each second
+func everySecond(t *testing.T) *config.Schedule {
+	schedule := &config.Schedule{}
+	assert.NoError(t, json.Unmarshal([]byte(`"*/1 * * * * *"`), schedule))
+	return schedule
+}
+
+func TestRunScheduled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var calls int32
+	done := make(chan bool)
+	go func() {
+		runScheduled(ctx, everySecond(t), func() {
+			atomic.AddInt32(&calls, 1)
+		})
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	//the scheduling stops if the context is done
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "the scheduling was not stopped")
+	}
+}
@@ -1,61 +1,280 @@
 package mqtt
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"fmt"
 	"github.com/rainu/mqtt-executor/internal/cmd"
 	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"go.uber.org/zap"
 	"sync"
 	"time"
 )
 
 type SensorWorker struct {
 	waitGroup  sync.WaitGroup
+	ctx        context.Context
 	cancelFunc context.CancelFunc
+	publishQOS byte
 
-	Executor   *cmd.CommandExecutor
-	MqttClient MQTT.Client
+	lock    sync.Mutex
+	sensors map[string][]context.CancelFunc
+
+	//the last published values (topic -> value) so that they can be republished (see Republish func)
+	valuesLock sync.Mutex
+	values     map[string]sensorValue
+
+	DeviceId      string
+	MessageExpiry time.Duration
+	Executor      *cmd.CommandExecutor
+	MqttClient    Client
+}
+
+type sensorValue struct {
+	payload  []byte
+	retained bool
+}
+
+// sensor is a (multi) sensor configuration together with the values which should be published to their own topics
+type sensor struct {
+	config.GeneralSensor
+	FanOut []fanOutValue
+}
+
+type fanOutValue struct {
+	Topic    string
+	JsonPath string
+}
+
+// sensorsOf collects all (multi) sensors of the given configuration
+func sensorsOf(topicConfig config.TopicConfigurations) []sensor {
+	sensors := make([]sensor, 0, len(topicConfig.Sensor)+len(topicConfig.MultiSensor))
+	for _, sensorConf := range topicConfig.Sensor {
+		sensors = append(sensors, sensor{GeneralSensor: sensorConf.GeneralSensor})
+	}
+	for _, sensorConf := range topicConfig.MultiSensor {
+		multiSensor := sensor{GeneralSensor: sensorConf.GeneralSensor}
+		if sensorConf.FanOut {
+			multiSensor.FanOut = make([]fanOutValue, 0, len(sensorConf.Values))
+			for _, value := range sensorConf.Values {
+				multiSensor.FanOut = append(multiSensor.FanOut, fanOutValue{
+					Topic:    sensorConf.ValueTopic(value),
+					JsonPath: value.JsonPath,
+				})
+			}
+		}
+		sensors = append(sensors, multiSensor)
+	}
+	return sensors
 }
 
-func (s *SensorWorker) Initialise(publishQOS byte, sensorConfigs []config.GeneralSensor) {
+func (s *SensorWorker) Initialise(publishQOS byte, topicConfig config.TopicConfigurations) {
+	s.publishQOS = publishQOS
+	s.sensors = map[string][]context.CancelFunc{}
+	s.values = map[string]sensorValue{}
 
 	//generate a context so that we can cancel it later (see Close func)
-	var ctx context.Context
-	ctx, s.cancelFunc = context.WithCancel(context.Background())
+	s.ctx, s.cancelFunc = context.WithCancel(context.Background())
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, sensorConf := range sensorsOf(topicConfig) {
+		s.startSensor(sensorConf)
+	}
+}
+
+// Reload applies the given sensor configurations. Only new or changed sensors will be (re)started and
+// removed sensors will be stopped.
+func (s *SensorWorker) Reload(topicConfig config.TopicConfigurations) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
+	sensorConfigs := sensorsOf(topicConfig)
+	newSensors := map[string][]sensor{}
 	for _, sensorConf := range sensorConfigs {
-		s.waitGroup.Add(1)
-		go s.runSensor(ctx, publishQOS, sensorConf)
+		key := sensorKey(sensorConf)
+		newSensors[key] = append(newSensors[key], sensorConf)
+	}
+
+	//stop all sensors which are not needed anymore
+	for key, cancelFuncs := range s.sensors {
+		keep := len(newSensors[key])
+		for len(cancelFuncs) > keep {
+			cancelFuncs[len(cancelFuncs)-1]()
+			cancelFuncs = cancelFuncs[:len(cancelFuncs)-1]
+		}
+
+		if len(cancelFuncs) == 0 {
+			delete(s.sensors, key)
+		} else {
+			s.sensors[key] = cancelFuncs
+		}
+	}
+
+	//start all sensors which are not running yet
+	for key, sensorConfs := range newSensors {
+		for _, sensorConf := range sensorConfs[len(s.sensors[key]):] {
+			zap.L().Info("Start sensor.", zap.String("topic", sensorConf.ResultTopic))
+			s.startSensor(sensorConf)
+		}
+	}
+
+	s.forgetValues(sensorConfigs)
+}
+
+// forgetValues removes the last values of all topics which are not used by the given sensors anymore
+func (s *SensorWorker) forgetValues(sensorConfigs []sensor) {
+	topics := map[string]bool{}
+	for _, sensorConf := range sensorConfigs {
+		topics[sensorConf.ResultTopic] = true
+		for _, value := range sensorConf.FanOut {
+			topics[value.Topic] = true
+		}
+	}
+
+	s.valuesLock.Lock()
+	defer s.valuesLock.Unlock()
+
+	for topic := range s.values {
+		if !topics[topic] {
+			delete(s.values, topic)
+		}
 	}
 }
 
-func (s *SensorWorker) runSensor(ctx context.Context, publishQOS byte, sensorConf config.GeneralSensor) {
+// Republish publishes the last value of each sensor again (ex. if home assistant was restarted)
+func (s *SensorWorker) Republish() {
+	s.valuesLock.Lock()
+	defer s.valuesLock.Unlock()
+
+	for topic, value := range s.values {
+		s.MqttClient.PublishWithProperties(topic, s.publishQOS, value.retained, value.payload, PublishProperties{
+			MessageExpiry: s.MessageExpiry,
+		})
+	}
+}
+
+func (s *SensorWorker) publishValue(topic string, publishQOS byte, retained bool, payload []byte) {
+	s.valuesLock.Lock()
+	s.values[topic] = sensorValue{payload: payload, retained: retained}
+	s.valuesLock.Unlock()
+
+	s.MqttClient.PublishWithProperties(topic, publishQOS, retained, payload, PublishProperties{
+		MessageExpiry: s.MessageExpiry,
+	})
+}
+
+func (s *SensorWorker) startSensor(sensorConf sensor) {
+	ctx, cancelFunc := context.WithCancel(s.ctx)
+
+	key := sensorKey(sensorConf)
+	s.sensors[key] = append(s.sensors[key], cancelFunc)
+
+	s.waitGroup.Add(1)
+	go s.runSensor(ctx, s.publishQOS, sensorConf)
+}
+
+// sensorKey generates a key which is identical for identical sensor configurations
+func sensorKey(sensorConf sensor) string {
+	key, err := json.Marshal(sensorConf)
+	if err != nil {
+		//the "marshalling" is relatively safe - it should never appear at runtime
+		panic(err)
+	}
+	return string(key)
+}
+
+func (s *SensorWorker) runSensor(ctx context.Context, publishQOS byte, sensorConf sensor) {
 	defer s.waitGroup.Done()
 
+	filter := newPublishFilter(sensorConf.GeneralSensor)
+
 	//first execution
-	s.executeCommand(ctx, publishQOS, sensorConf)
+	s.executeCommand(ctx, publishQOS, sensorConf, filter)
+
+	if sensorConf.Schedule != nil {
+		runScheduled(ctx, sensorConf.Schedule, func() {
+			s.executeCommand(ctx, publishQOS, sensorConf, filter)
+		})
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(sensorConf.Interval))
+	defer ticker.Stop()
 
-	ticker := time.Tick(time.Duration(sensorConf.Interval))
 	for {
 		//wait until next tick or shutdown
 		select {
-		case <-ticker:
-			s.executeCommand(ctx, publishQOS, sensorConf)
+		case <-ticker.C:
+			s.executeCommand(ctx, publishQOS, sensorConf, filter)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (s *SensorWorker) executeCommand(ctx context.Context, publishQOS byte, sensorConf config.GeneralSensor) {
-	output, execErr := s.Executor.ExecuteCommandWithContext(sensorConf.Command.Name, sensorConf.Command.Arguments, ctx)
-	if execErr != nil {
-		s.MqttClient.Publish(sensorConf.ResultTopic, publishQOS, sensorConf.Retained, "<FAILED>;"+execErr.Error())
+func (s *SensorWorker) executeCommand(ctx context.Context, publishQOS byte, sensorConf sensor, filter *publishFilter) {
+	execution := newExecution(sensorConf.Command, map[string]string{
+		EnvDeviceId: s.DeviceId,
+		EnvTopic:    sensorConf.ResultTopic,
+	})
+
+	result, execErr := s.Executor.ExecuteWithContext(execution, ctx)
+	if ctx.Err() != nil {
+		//the sensor was stopped (shutdown or reload) -> there is nothing to publish
 		return
 	}
+	if execErr == nil && sensorConf.Parse != nil {
+		//the parser works on stdout only (stderr could contain some noise)
+		parsed, err := parseOutput(*sensorConf.Parse, result.Stdout)
+		if err != nil {
+			zap.L().Warn("Could not parse sensor output.", zap.String("topic", sensorConf.ResultTopic), zap.Error(err))
+			execErr = fmt.Errorf("could not parse output: %w", err)
+		} else {
+			result.Output = parsed
+			result.Stdout = parsed
+		}
+	}
 
-	s.MqttClient.Publish(sensorConf.ResultTopic, publishQOS, sensorConf.Retained, output)
+	//the raw result is used for comparison because the json result contains always changing fields (like duration)
+	if !filter.ShouldPublish(resultPayload(nil, result, execErr), time.Now()) {
+		return
+	}
+
+	s.publishValue(sensorConf.ResultTopic, publishQOS, sensorConf.Retained, resultPayload(sensorConf.Result, result, execErr))
+	publishResultSubTopics(s.MqttClient, sensorConf.ResultTopic, publishQOS, sensorConf.Retained, sensorConf.Result, result)
+
+	if len(sensorConf.FanOut) > 0 {
+		s.publishFanOut(publishQOS, sensorConf, result, execErr)
+	}
+}
+
+// publishFanOut publishes each value of the (json) output to its own topic
+func (s *SensorWorker) publishFanOut(publishQOS byte, sensorConf sensor, result cmd.Result, execErr error) {
+	var data interface{}
+	if execErr == nil {
+		decoder := json.NewDecoder(bytes.NewReader(result.Stdout))
+		decoder.UseNumber()
+		if err := decoder.Decode(&data); err != nil {
+			execErr = fmt.Errorf("invalid json: %w", err)
+		}
+	}
+
+	for _, value := range sensorConf.FanOut {
+		var payload []byte
+		if execErr != nil {
+			payload = resultPayload(nil, result, execErr)
+		} else if resolved, err := resolveJsonPath(data, value.JsonPath); err != nil {
+			payload = resultPayload(nil, result, err)
+		} else {
+			payload = []byte(stringify(resolved))
+		}
+
+		s.publishValue(value.Topic, publishQOS, sensorConf.Retained, payload)
+	}
 }
 
 func (s *SensorWorker) Close(timeout time.Duration) error {
@@ -0,0 +1,155 @@
+package mqtt
+
+import (
+	"github.com/rainu/mqtt-executor/internal/cmd"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSensorWorker_Republish(t *testing.T) {
+	client := &fakeClient{}
+	sensorWorker := &SensorWorker{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	sensorWorker.Initialise(1, config.TopicConfigurations{Sensor: []config.Sensor{{
+		GeneralSensor: config.GeneralSensor{
+			ResultTopic: "tele/test",
+			Interval:    config.Interval(time.Hour),
+			Command: config.Command{
+				Name:      "/bin/echo",
+				Arguments: []string{"42"},
+			},
+		},
+	}}})
+
+	assert.Eventually(t, func() bool {
+		return len(client.messages("tele/test")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	sensorWorker.Republish()
+	assert.Equal(t, []string{"42", "42"}, client.messages("tele/test"))
+
+	//the values of removed sensors will not be republished
+	sensorWorker.Reload(config.TopicConfigurations{})
+	sensorWorker.Republish()
+	assert.Equal(t, []string{"42", "42"}, client.messages("tele/test"))
+
+	assert.NoError(t, sensorWorker.Close(time.Second))
+}
+
+func TestSensorWorker_Schedule(t *testing.T) {
+	client := &fakeClient{}
+	sensorWorker := &SensorWorker{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	sensorWorker.Initialise(1, config.TopicConfigurations{Sensor: []config.Sensor{{
+		GeneralSensor: config.GeneralSensor{
+			ResultTopic: "tele/test",
+			Schedule:    everySecond(t),
+			Command: config.Command{
+				Name:      "/bin/echo",
+				Arguments: []string{"42"},
+			},
+		},
+	}}})
+
+	//the sensor is executed at each scheduled time
+	assert.Eventually(t, func() bool {
+		return len(client.messages("tele/test")) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, sensorWorker.Close(time.Second))
+
+	assert.Equal(t, []string{"42", "42"}, client.messages("tele/test")[:2])
+}
+
+func TestSensorsOf(t *testing.T) {
+	topicConfig := config.TopicConfigurations{
+		Sensor: []config.Sensor{{
+			GeneralSensor: config.GeneralSensor{ResultTopic: "tele/uptime"},
+		}},
+		MultiSensor: []config.MultiSensor{{
+			GeneralSensor: config.GeneralSensor{ResultTopic: "tele/stats"},
+			FanOut:        true,
+			Values: []config.MultiSensorValue{
+				{Name: "Free Memory", JsonPath: "mem.free"},
+				{Name: "CPU", JsonPath: "cpu"},
+			},
+		}, {
+			GeneralSensor: config.GeneralSensor{ResultTopic: "tele/disk"},
+			Values: []config.MultiSensorValue{
+				{Name: "Free", JsonPath: "free"},
+			},
+		}},
+	}
+
+	assert.Equal(t, []sensor{
+		{GeneralSensor: config.GeneralSensor{ResultTopic: "tele/uptime"}},
+		{
+			GeneralSensor: config.GeneralSensor{ResultTopic: "tele/stats"},
+			FanOut: []fanOutValue{
+				{Topic: "tele/stats/Free_Memory", JsonPath: "mem.free"},
+				{Topic: "tele/stats/CPU", JsonPath: "cpu"},
+			},
+		},
+		{GeneralSensor: config.GeneralSensor{ResultTopic: "tele/disk"}},
+	}, sensorsOf(topicConfig))
+}
+
+func TestSensorWorker_Reload(t *testing.T) {
+	echoSensor := func(topic, output string) config.Sensor {
+		return config.Sensor{GeneralSensor: config.GeneralSensor{
+			ResultTopic: topic,
+			Interval:    config.Interval(time.Hour),
+			Command: config.Command{
+				Name:      "/bin/echo",
+				Arguments: []string{output},
+			},
+		}}
+	}
+
+	client := &fakeClient{}
+	sensorWorker := &SensorWorker{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	sensorWorker.Initialise(1, config.TopicConfigurations{Sensor: []config.Sensor{
+		echoSensor("tele/unchanged", "1"),
+		echoSensor("tele/changed", "1"),
+	}})
+	assert.Eventually(t, func() bool {
+		return len(client.messages("tele/unchanged")) == 1 && len(client.messages("tele/changed")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	sensorWorker.Reload(config.TopicConfigurations{Sensor: []config.Sensor{
+		echoSensor("tele/unchanged", "1"),
+		echoSensor("tele/changed", "2"),
+		echoSensor("tele/added", "3"),
+	}})
+	assert.Eventually(t, func() bool {
+		return len(client.messages("tele/changed")) == 2 && len(client.messages("tele/added")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	//unchanged sensors will not be restarted
+	assert.Equal(t, []string{"1"}, client.messages("tele/unchanged"))
+	assert.Equal(t, []string{"1", "2"}, client.messages("tele/changed"))
+	assert.Equal(t, []string{"3"}, client.messages("tele/added"))
+
+	sensorWorker.lock.Lock()
+	assert.Len(t, sensorWorker.sensors, 3)
+	sensorWorker.lock.Unlock()
+
+	//removed sensors will be stopped
+	sensorWorker.Reload(config.TopicConfigurations{Sensor: []config.Sensor{
+		echoSensor("tele/unchanged", "1"),
+	}})
+	sensorWorker.lock.Lock()
+	assert.Len(t, sensorWorker.sensors, 1)
+	sensorWorker.lock.Unlock()
+	assert.Equal(t, []string{"1"}, client.messages("tele/unchanged"))
+
+	assert.NoError(t, sensorWorker.Close(time.Second))
+}
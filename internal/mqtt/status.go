@@ -3,7 +3,6 @@ package mqtt
 import (
 	"context"
 	"errors"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rainu/mqtt-executor/internal/mqtt/config"
 	"sync"
 	"time"
@@ -13,7 +12,7 @@ type StatusWorker struct {
 	waitGroup  sync.WaitGroup
 	cancelFunc context.CancelFunc
 
-	MqttClient MQTT.Client
+	MqttClient Client
 }
 
 func (s *StatusWorker) Initialise(availabilityConfigs config.Availability) {
@@ -0,0 +1,84 @@
+package mqtt
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+const TopicSuffixOutput = "OUTPUT"
+
+// outputStream publishes the output lines of a running command. If an interval is given, the lines will be
+// collected and published at most once per interval.
+type outputStream struct {
+	lock    sync.Mutex
+	lines   [][]byte
+	batched bool
+	publish func(payload []byte)
+
+	waitGroup sync.WaitGroup
+	done      chan bool
+}
+
+func newOutputStream(interval time.Duration, publish func(payload []byte)) *outputStream {
+	s := &outputStream{
+		batched: interval > 0,
+		publish: publish,
+		done:    make(chan bool),
+	}
+
+	if s.batched {
+		s.waitGroup.Add(1)
+		go s.run(interval)
+	}
+
+	return s
+}
+
+func (s *outputStream) run(interval time.Duration) {
+	defer s.waitGroup.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// HandleLine publishes the given line (or collect it for the next batch)
+func (s *outputStream) HandleLine(line []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.batched {
+		//the line buffer will be reused by the caller
+		s.lines = append(s.lines, append([]byte{}, line...))
+	} else {
+		s.publish(append([]byte{}, line...))
+	}
+}
+
+func (s *outputStream) flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.lines) == 0 {
+		return
+	}
+
+	s.publish(bytes.Join(s.lines, []byte("\n")))
+	s.lines = nil
+}
+
+// Close stops the stream and publishes the remaining lines
+func (s *outputStream) Close() {
+	close(s.done)
+	s.waitGroup.Wait()
+	s.flush()
+}
@@ -0,0 +1,44 @@
+package mqtt
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutputStream_unbatched(t *testing.T) {
+	var published []string
+	stream := newOutputStream(0, func(payload []byte) {
+		published = append(published, string(payload))
+	})
+
+	stream.HandleLine([]byte("line 1"))
+	stream.HandleLine([]byte("line 2"))
+	assert.Equal(t, []string{"line 1", "line 2"}, published)
+
+	stream.Close()
+	assert.Equal(t, []string{"line 1", "line 2"}, published)
+}
+
+func TestOutputStream_batched(t *testing.T) {
+	lock := sync.Mutex{}
+	var published []string
+	stream := newOutputStream(time.Hour, func(payload []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		published = append(published, string(payload))
+	})
+
+	stream.HandleLine([]byte("line 1"))
+	stream.HandleLine([]byte("line 2"))
+	stream.flush()
+	stream.HandleLine([]byte("line 3"))
+
+	lock.Lock()
+	assert.Equal(t, []string{"line 1\nline 2"}, published)
+	lock.Unlock()
+
+	stream.Close()
+	assert.Equal(t, []string{"line 1\nline 2", "line 3"}, published)
+}
@@ -2,11 +2,13 @@ package mqtt
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rainu/mqtt-executor/internal/cmd"
 	"github.com/rainu/mqtt-executor/internal/mqtt/config"
 	"go.uber.org/zap"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -15,171 +17,507 @@ import (
 const (
 	TopicSuffixState     = "STATE"
 	TopicSuffixResult    = "RESULT"
+	TopicSuffixExecution = "EXECUTION"
 	PayloadStatusRunning = "RUNNING"
 	PayloadStatusStopped = "STOPPED"
-	PayloadStart         = "START"
-	PayloadStop          = "STOP"
+	PayloadStart         = config.PayloadStart
+	PayloadStop          = config.PayloadStop
+)
+
+var (
+	errInvalidPayload = errors.New("invalid payload")
+	errAlreadyRunning = errors.New("command is already running")
+	errQueueFull      = errors.New("queue is full")
+	errNotRunning     = errors.New("command is not running")
 )
 
 type Trigger struct {
-	initialised     bool
-	lock            sync.RWMutex
-	runningCommands map[string]context.CancelFunc
-	triggerConfigs  []config.Trigger
-	subscriptions   map[string]subscription
-	subscribeQOS    byte
-	publishQOS      byte
+	initialised      bool
+	lock             sync.Mutex
+	executions       map[string]*triggerExecutions
+	subscriptionLock sync.Mutex
+	subscriptions    map[string]subscription
+	subscribeQOS     byte
+	publishQOS       byte
+
+	schedulerCtx        context.Context
+	schedulerWaitGroup  sync.WaitGroup
+	schedulerCancelFunc context.CancelFunc
+
+	DeviceId      string
+	MessageExpiry time.Duration
+	Executor      *cmd.CommandExecutor
+	MqttClient    Client
+}
+
+// request contains the (MQTT 5) properties of the incoming message. They are empty for MQTT 3.1.1.
+// In rpc mode the response topic and the id can also be given by the rpc envelope.
+type request struct {
+	responseTopic   string
+	correlationData []byte
+	userProperties  map[string]string
+
+	rpc bool
+	id  json.RawMessage
+}
+
+// runningExecution is a running command execution of a trigger
+type runningExecution struct {
+	id     string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// pendingExecution is a queued command execution of a trigger (see config.ConcurrencyQueue)
+type pendingExecution struct {
+	topic  string
+	input  triggerInput
+	req    request
+	result *config.Result
+}
 
-	Executor   *cmd.CommandExecutor
-	MqttClient MQTT.Client
+// triggerExecutions contains all running and queued executions of a trigger
+type triggerExecutions struct {
+	running []*runningExecution
+	queue   []pendingExecution
 }
 
 type subscription struct {
-	trigger config.Trigger
-	handler MQTT.MessageHandler
+	trigger         config.Trigger
+	handler         MessageHandler
+	cancelScheduler context.CancelFunc
 }
 
 func (t *Trigger) Initialise(subscribeQOS, publishQOS byte, triggerConfigs []config.Trigger) {
 	t.subscribeQOS = subscribeQOS
 	t.publishQOS = publishQOS
-	t.runningCommands = map[string]context.CancelFunc{}
-	t.subscriptions = map[string]subscription{}
-	t.triggerConfigs = triggerConfigs //safe the configs so that we can unsubscribe later (see Close func)
+	t.executions = map[string]*triggerExecutions{}
+	t.subscriptions = map[string]subscription{} //safe the subscriptions so that we can unsubscribe later (see Close func)
 
-	for _, triggerConf := range triggerConfigs {
-		t.subscriptions[triggerConf.Name] = subscription{
-			trigger: triggerConf,
-			handler: t.createTriggerHandler(triggerConf),
-		}
+	//generate a context so that we can cancel the scheduler later (see Close func)
+	t.schedulerCtx, t.schedulerCancelFunc = context.WithCancel(context.Background())
 
-		t.MqttClient.Subscribe(triggerConf.Topic, subscribeQOS, t.subscriptions[triggerConf.Name].handler)
+	t.subscriptionLock.Lock()
+	defer t.subscriptionLock.Unlock()
 
-		//publish the stopped state on startup
-		t.publishStatus(triggerConf.Topic, PayloadStatusStopped)
+	for _, triggerConf := range triggerConfigs {
+		t.register(triggerConf)
 	}
 
 	t.initialised = true
 }
 
+func (t *Trigger) register(triggerConf config.Trigger) {
+	//the schema is prepared only once for all messages
+	schema := newPayloadSchema(triggerConf)
+	sub := subscription{
+		trigger: triggerConf,
+		handler: t.createTriggerHandler(triggerConf, schema),
+	}
+
+	t.MqttClient.Subscribe(triggerConf.Topic, t.subscribeQOS, sub.handler)
+
+	//publish the current state on startup
+	t.publishCurrentStatus(triggerConf)
+
+	if triggerConf.Schedule != nil {
+		var ctx context.Context
+		ctx, sub.cancelScheduler = context.WithCancel(t.schedulerCtx)
+
+		t.schedulerWaitGroup.Add(1)
+		go t.runScheduler(ctx, triggerConf, schema)
+	}
+
+	t.subscriptions[triggerConf.Name] = sub
+}
+
+func (t *Trigger) unregister(sub subscription) {
+	t.MqttClient.Unsubscribe(sub.trigger.Topic)
+
+	if sub.cancelScheduler != nil {
+		sub.cancelScheduler()
+	}
+
+	delete(t.subscriptions, sub.trigger.Name)
+}
+
+// Reload applies the given trigger configurations. Only new, changed or removed triggers will be (un)subscribed.
+// Running commands are not affected.
+func (t *Trigger) Reload(triggerConfigs []config.Trigger) {
+	t.subscriptionLock.Lock()
+	defer t.subscriptionLock.Unlock()
+
+	newConfigs := map[string]config.Trigger{}
+	for _, triggerConf := range triggerConfigs {
+		newConfigs[triggerConf.Name] = triggerConf
+	}
+
+	for name, sub := range t.subscriptions {
+		if newConf, exists := newConfigs[name]; !exists || !reflect.DeepEqual(newConf, sub.trigger) {
+			zap.L().Info("Remove trigger.", zap.String("trigger", name))
+			t.unregister(sub)
+		}
+	}
+	for _, triggerConf := range triggerConfigs {
+		if _, exists := t.subscriptions[triggerConf.Name]; !exists {
+			zap.L().Info("Add trigger.", zap.String("trigger", triggerConf.Name))
+			t.register(triggerConf)
+		}
+	}
+}
+
 func (t *Trigger) IsInitialised() bool {
 	return t.initialised
 }
 
 func (t *Trigger) ReInitialise() {
-	for triggerName, subscription := range t.subscriptions {
+	t.subscriptionLock.Lock()
+	defer t.subscriptionLock.Unlock()
+
+	for _, subscription := range t.subscriptions {
 		t.MqttClient.Subscribe(subscription.trigger.Topic, t.subscribeQOS, subscription.handler)
 
 		//publish the current state on reinitialisation
-		if t.isCommandRunning(triggerName) {
-			t.publishStatus(subscription.trigger.Topic, PayloadStatusRunning)
-		} else {
-			t.publishStatus(subscription.trigger.Topic, PayloadStatusStopped)
-		}
+		t.publishCurrentStatus(subscription.trigger)
 	}
 }
 
-func (t *Trigger) createTriggerHandler(triggerConfig config.Trigger) MQTT.MessageHandler {
-	return func(client MQTT.Client, message MQTT.Message) {
+// RepublishStatus publishes the current state of each trigger again (ex. if home assistant was restarted)
+func (t *Trigger) RepublishStatus() {
+	t.subscriptionLock.Lock()
+	defer t.subscriptionLock.Unlock()
+
+	for _, subscription := range t.subscriptions {
+		t.publishCurrentStatus(subscription.trigger)
+	}
+}
+
+func (t *Trigger) publishCurrentStatus(triggerConf config.Trigger) {
+	if t.isCommandRunning(triggerConf.Name) {
+		t.publishStatus(triggerConf.Topic, PayloadStatusRunning)
+	} else {
+		t.publishStatus(triggerConf.Topic, PayloadStatusStopped)
+	}
+}
+
+func (t *Trigger) createTriggerHandler(triggerConfig config.Trigger, schema *payloadSchema) MessageHandler {
+	return func(message Message) {
 		zap.L().Info("Incoming message: ",
-			zap.String("topic", message.Topic()),
-			zap.ByteString("payload", message.Payload()),
+			zap.String("topic", message.Topic),
+			zap.ByteString("payload", message.Payload),
 		)
 
-		action := strings.ToUpper(string(message.Payload()))
-
-		switch action {
-		case PayloadStart:
-			//ensure that only one trigger runs at the same time
-			if t.isCommandRunning(triggerConfig.Name) {
-				zap.L().Warn("Command is already running. Skip execution!", zap.String("trigger", triggerConfig.Name))
+		payload := message.Payload
+		req := request{
+			responseTopic:   message.ResponseTopic,
+			correlationData: message.CorrelationData,
+			userProperties:  message.UserProperties,
+		}
+		if req.responseTopic != "" && triggerConfig.RpcReplyPrefix != "" {
+			//the MQTT 5 response topic is restricted in the same way as the reply topic of the envelope
+			if err := checkReplyTopic(req.responseTopic, triggerConfig.RpcReplyPrefix); err != nil {
+				zap.L().Warn("Invalid response topic. Do nothing.", zap.String("trigger", triggerConfig.Name), zap.Error(err))
+				t.publishResult(message.Topic, triggerConfig.Result, request{}, resultPayload(triggerConfig.Result, cmd.Result{ExitCode: -1}, err))
 				return
 			}
-
-			go t.executeCommand(message.Topic(), triggerConfig)
-		case PayloadStop:
-			if !t.isCommandRunning(triggerConfig.Name) {
-				//no command running -> no action
+		}
+		if triggerConfig.Rpc {
+			if envelope, inner, ok := parseRpcEnvelope(payload); ok {
+				if err := checkReplyTopic(envelope.ReplyTo, triggerConfig.RpcReplyPrefix); err != nil {
+					zap.L().Warn("Invalid reply topic. Do nothing.", zap.String("trigger", triggerConfig.Name), zap.Error(err))
+					t.publishResult(message.Topic, triggerConfig.Result, req, resultPayload(triggerConfig.Result, cmd.Result{ExitCode: -1}, err))
+					return
+				}
+
+				payload = inner
+				req.responseTopic = envelope.ReplyTo
+				req.rpc = true
+				req.id = envelope.Id
+			}
+		}
+		action := strings.ToUpper(string(payload))
+
+		switch {
+		case action == PayloadStart:
+			t.startCommand(message.Topic, triggerConfig, schema, triggerInput{}, req)
+		case action == PayloadStop:
+			t.stopCommands(triggerConfig, req)
+		case triggerConfig.Payload != nil:
+			//all other payloads are the input for the command
+			input, err := parsePayload(*triggerConfig.Payload, payload)
+			if err != nil {
+				zap.L().Warn("Payload rejected. Do nothing.", zap.String("trigger", triggerConfig.Name), zap.Error(err))
+				t.publishResult(message.Topic, triggerConfig.Result, req, resultPayload(triggerConfig.Result, cmd.Result{ExitCode: -1}, err))
 				return
 			}
-			t.interruptCommand(triggerConfig)
-			t.unregisterCommand(triggerConfig)
+
+			t.startCommand(message.Topic, triggerConfig, schema, input, req)
 		default:
 			zap.L().Warn("Invalid payload. Do nothing.")
+			t.publishResponse(req, triggerConfig.Result, resultPayload(triggerConfig.Result, cmd.Result{ExitCode: -1}, errInvalidPayload))
 		}
 	}
 }
 
-func (t *Trigger) isCommandRunning(triggerName string) bool {
-	//we only need read access
-	t.lock.RLock()
-	defer t.lock.RUnlock()
+func (t *Trigger) startCommand(topic string, triggerConfig config.Trigger, schema *payloadSchema, input triggerInput, req request) {
+	//the schema applies to all executions (a simple START has an empty input)
+	if err := validateInput(schema, input); err != nil {
+		zap.L().Warn("Payload rejected. Do nothing.", zap.String("trigger", triggerConfig.Name), zap.Error(err))
+		t.publishResult(topic, triggerConfig.Result, req, resultPayload(triggerConfig.Result, cmd.Result{ExitCode: -1}, err))
+		return
+	}
 
-	_, exist := t.runningCommands[triggerName]
-	return exist
-}
+	concurrency := config.Concurrency{Mode: config.ConcurrencySkip}
+	if triggerConfig.Concurrency != nil {
+		concurrency = *triggerConfig.Concurrency
+	}
 
-func (t *Trigger) registerCommand(trigger config.Trigger) context.Context {
-	//we need write access
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
+	executions, exists := t.executions[triggerConfig.Name]
+	if !exists {
+		executions = &triggerExecutions{}
+		t.executions[triggerConfig.Name] = executions
+	}
+
+	var previous []*runningExecution
+	switch {
+	case len(executions.running) == 0:
+		//nothing is running -> start immediately
+	case concurrency.Mode == config.ConcurrencyQueue:
+		if len(executions.queue) >= concurrency.Limit {
+			t.rejectCommand(triggerConfig, req, errQueueFull)
+			return
+		}
+		zap.L().Info("Command is already running. Queue execution.", zap.String("trigger", triggerConfig.Name))
+		executions.queue = append(executions.queue, pendingExecution{topic: topic, input: input, req: req, result: triggerConfig.Result})
+		return
+	case concurrency.Mode == config.ConcurrencyReplace:
+		//stop all running executions (the new one waits until they are finished)
+		zap.L().Info("Command is already running. Replace execution.", zap.String("trigger", triggerConfig.Name))
+		previous = executions.running
+		for _, execution := range previous {
+			execution.cancel()
+		}
+	case concurrency.Mode == config.ConcurrencyParallel && len(executions.running) < concurrency.Limit:
+		//there are free slots
+	default:
+		t.rejectCommand(triggerConfig, req, errAlreadyRunning)
+		return
+	}
+
+	t.runCommand(topic, triggerConfig, input, req, executions, previous)
+}
+
+// runCommand registers a new execution and runs it in background. The lock must be held by the caller!
+func (t *Trigger) runCommand(topic string, triggerConfig config.Trigger, input triggerInput, req request, executions *triggerExecutions, previous []*runningExecution) {
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	t.runningCommands[trigger.Name] = cancelFunc
+	execution := &runningExecution{
+		id:     newExecutionId(),
+		cancel: cancelFunc,
+		done:   make(chan struct{}),
+	}
+	executions.running = append(executions.running, execution)
 
-	return ctx
+	go t.executeCommand(ctx, topic, triggerConfig, input, req, execution, previous)
 }
 
-func (t *Trigger) unregisterCommand(trigger config.Trigger) {
-	//we need write access
+// finishCommand unregisters the given execution and starts the next queued one (if any)
+func (t *Trigger) finishCommand(trigger config.Trigger, execution *runningExecution) {
+	//call the cancel func to release the resources
+	execution.cancel()
+	close(execution.done)
+
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	//call the cancel func to release the resources
-	t.runningCommands[trigger.Name]()
+	executions := t.executions[trigger.Name]
+	for i, running := range executions.running {
+		if running == execution {
+			executions.running = append(executions.running[:i], executions.running[i+1:]...)
+			break
+		}
+	}
+
+	if len(executions.running) == 0 && len(executions.queue) > 0 && t.schedulerCtx.Err() == nil {
+		next := executions.queue[0]
+		executions.queue = executions.queue[1:]
+		t.runCommand(next.topic, trigger, next.input, next.req, executions, nil)
+	}
+	if len(executions.running) == 0 {
+		//the state is the aggregate of all executions -> we are stopped if the last one is finished
+		t.publishStatus(trigger.Topic, PayloadStatusStopped)
+	}
+	if len(executions.running) == 0 && len(executions.queue) == 0 {
+		delete(t.executions, trigger.Name)
+	}
+}
+
+// stopCommands interrupts all running executions of the given trigger. Queued executions will be discarded.
+func (t *Trigger) stopCommands(trigger config.Trigger, req request) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	executions, exists := t.executions[trigger.Name]
+	if !exists {
+		//no command running -> no action
+		t.publishResponse(req, trigger.Result, resultPayload(trigger.Result, cmd.Result{ExitCode: -1}, errNotRunning))
+		return
+	}
+
+	t.discardQueue(executions)
 
-	delete(t.runningCommands, trigger.Name)
+	for _, execution := range executions.running {
+		execution.cancel()
+	}
+	t.publishResponse(req, trigger.Result, resultPayload(trigger.Result, cmd.Result{ExitCode: -1}, context.Canceled))
 }
 
-func (t *Trigger) interruptCommand(trigger config.Trigger) {
-	//we only need read access
-	t.lock.RLock()
-	defer t.lock.RUnlock()
+// discardQueue removes all queued executions and answers them with <INTERRUPTED>. The lock must be held by the caller!
+func (t *Trigger) discardQueue(executions *triggerExecutions) {
+	for _, pending := range executions.queue {
+		t.publishResponse(pending.req, pending.result, resultPayload(pending.result, cmd.Result{ExitCode: -1}, context.Canceled))
+	}
+	executions.queue = nil
+}
 
-	//execute corresponding cancel func
-	t.runningCommands[trigger.Name]()
+func (t *Trigger) rejectCommand(trigger config.Trigger, req request, reason error) {
+	zap.L().Warn("Skip execution!", zap.String("trigger", trigger.Name), zap.Error(reason))
+	t.publishResponse(req, trigger.Result, resultPayload(trigger.Result, cmd.Result{ExitCode: -1}, reason))
 }
 
-func (t *Trigger) executeCommand(topic string, trigger config.Trigger) {
-	ctx := t.registerCommand(trigger)  //register at begin
-	defer t.unregisterCommand(trigger) //unregister at end
+func (t *Trigger) runScheduler(ctx context.Context, triggerConfig config.Trigger, schema *payloadSchema) {
+	defer t.schedulerWaitGroup.Done()
+
+	runScheduled(ctx, triggerConfig.Schedule, func() {
+		zap.L().Info("Scheduled execution.", zap.String("trigger", triggerConfig.Name))
+
+		//this is the same as an incoming START-Message
+		t.startCommand(triggerConfig.Topic, triggerConfig, schema, triggerInput{}, request{})
+	})
+}
+
+func (t *Trigger) isCommandRunning(triggerName string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	executions, exists := t.executions[triggerName]
+	return exists && len(executions.running) > 0
+}
+
+func (t *Trigger) executeCommand(ctx context.Context, topic string, trigger config.Trigger, input triggerInput, req request, execution *runningExecution, previous []*runningExecution) {
+	defer t.finishCommand(trigger, execution) //unregister at end
+
+	//wait until the replaced executions are finished
+	for _, prev := range previous {
+		<-prev.done
+	}
 
-	t.publishStatus(topic, PayloadStatusRunning)       //publish that we are now running
-	defer t.publishStatus(topic, PayloadStatusStopped) //at the end we are stopped
+	//the execution id is only part of the payloads if multiple executions can run at the same time
+	executionId := ""
+	if trigger.Concurrency != nil && trigger.Concurrency.Mode == config.ConcurrencyParallel {
+		executionId = execution.id
+	}
 
-	output, execErr := t.Executor.ExecuteCommandWithContext(trigger.Command.Name, trigger.Command.Arguments, ctx)
-	if execErr != nil {
-		if execErr == context.Canceled {
-			//this can happen if a STOPPED-Message was incoming or the application is shutting down
-			t.publishResult(topic, "<INTERRUPTED>")
-		} else {
-			//program execution failed (status code != 0)
-			t.publishResult(topic, "<FAILED>;"+execErr.Error())
+	builtinEnv := map[string]string{
+		EnvDeviceId:    t.DeviceId,
+		EnvTriggerName: trigger.Name,
+		EnvTopic:       topic,
+		EnvExecutionId: execution.id,
+	}
+	if trigger.Payload == nil || trigger.Payload.Schema == nil {
+		//the user properties can not be validated -> they are only available if the input is not restricted
+		for key, value := range req.userProperties {
+			builtinEnv[EnvPropertyPrefix+envName(key)] = value
+		}
+	}
+
+	cmdExecution := newExecution(trigger.Command, builtinEnv)
+	//triggers are started by a user (or another system) which is waiting for the result - sensors can wait
+	cmdExecution.Priority = cmd.PriorityHigh
+	started := false
+	cmdExecution.StartHandler = func() {
+		//publish that we are now running (the stopped state will be published if the last execution is finished)
+		t.publishStatus(topic, PayloadStatusRunning)
+
+		if executionId != "" {
+			started = true
+			t.publishExecutionStatus(topic, PayloadStatusRunning, executionId)
+		}
+	}
+	if trigger.Payload != nil {
+		if err := applyInput(&cmdExecution, *trigger.Payload, input); err != nil {
+			t.publishResult(topic, trigger.Result, req, resultPayloadWithId(trigger.Result, executionId, cmd.Result{ExitCode: -1}, err))
+			return
 		}
-		return
 	}
 
-	//publish the program's output (stdout & stderr)
-	t.publishResult(topic, output)
+	var stream *outputStream
+	if trigger.Stream != nil {
+		stream = newOutputStream(time.Duration(trigger.Stream.Interval), func(payload []byte) {
+			t.publishOutput(topic, payload)
+		})
+		cmdExecution.OutputHandler = stream.HandleLine
+	}
+
+	result, execErr := t.Executor.ExecuteWithContext(cmdExecution, ctx)
+	if stream != nil {
+		//the remaining output should be published before the result
+		stream.Close()
+	}
+
+	//publish the program's output (stdout & stderr) or the reason of failure
+	t.publishResult(topic, trigger.Result, req, resultPayloadWithId(trigger.Result, executionId, result, execErr))
+	publishResultSubTopics(t.MqttClient, topic, t.publishQOS, false, trigger.Result, result)
+
+	if started {
+		t.publishExecutionStatus(topic, PayloadStatusStopped, executionId)
+	}
 }
 
-func (t *Trigger) publishStatus(parentTopic, status string) MQTT.Token {
+func (t *Trigger) publishStatus(parentTopic, status string) Token {
 	stateTopic := t.buildStateTopic(parentTopic)
 	return t.MqttClient.Publish(stateTopic, t.publishQOS, false, status)
 }
 
-func (t *Trigger) publishResult(parentTopic string, result interface{}) MQTT.Token {
+// publishExecutionStatus publishes the state of a single execution (in parallel mode): <STATE>;<ID>
+func (t *Trigger) publishExecutionStatus(parentTopic, status, executionId string) Token {
+	executionTopic := fmt.Sprintf("%s/%s", parentTopic, TopicSuffixExecution)
+	return t.MqttClient.Publish(executionTopic, t.publishQOS, false, status+";"+executionId)
+}
+
+func (t *Trigger) publishResult(parentTopic string, resultConfig *config.Result, req request, result []byte) {
 	resultTopic := t.buildResultTopic(parentTopic)
-	return t.MqttClient.Publish(resultTopic, t.publishQOS, false, result)
+	t.MqttClient.PublishWithProperties(resultTopic, t.publishQOS, false, result, PublishProperties{
+		MessageExpiry: t.MessageExpiry,
+	})
+
+	t.publishResponse(req, resultConfig, result)
+}
+
+// publishResponse publishes the result to the response topic of the caller (MQTT 5 request/response or rpc mode)
+func (t *Trigger) publishResponse(req request, resultConfig *config.Result, result []byte) {
+	if req.responseTopic == "" {
+		//the caller does not want a response
+		return
+	}
+
+	if req.rpc {
+		result = rpcResponsePayload(req.id, resultConfig, result)
+	}
+
+	t.MqttClient.PublishWithProperties(req.responseTopic, t.publishQOS, false, result, PublishProperties{
+		CorrelationData: req.correlationData,
+		MessageExpiry:   t.MessageExpiry,
+	})
+}
+
+func (t *Trigger) publishOutput(parentTopic string, output []byte) Token {
+	outputTopic := fmt.Sprintf("%s/%s", parentTopic, TopicSuffixOutput)
+	return t.MqttClient.PublishWithProperties(outputTopic, t.publishQOS, false, output, PublishProperties{
+		MessageExpiry: t.MessageExpiry,
+	})
 }
 
 func (t *Trigger) buildStateTopic(parentTopic string) string {
@@ -191,10 +529,36 @@ func (t *Trigger) buildResultTopic(parentTopic string) string {
 }
 
 func (t *Trigger) Close(timeout time.Duration) error {
-	//unsubscribe to all mqtt-topics (ignore the timeout!)
-	for _, triggerConf := range t.triggerConfigs {
-		t.MqttClient.Unsubscribe(triggerConf.Topic)
+	if t.schedulerCancelFunc != nil {
+		//stop the scheduler so that no new commands will be started
+		t.schedulerCancelFunc()
+	}
+
+	//the queued executions will never be started
+	t.lock.Lock()
+	for _, executions := range t.executions {
+		t.discardQueue(executions)
 	}
+	t.lock.Unlock()
 
-	return nil
+	//unsubscribe to all mqtt-topics (ignore the timeout!)
+	t.subscriptionLock.Lock()
+	for _, sub := range t.subscriptions {
+		t.MqttClient.Unsubscribe(sub.trigger.Topic)
+	}
+	t.subscriptionLock.Unlock()
+
+	wgChan := make(chan bool)
+	go func() {
+		t.schedulerWaitGroup.Wait()
+		wgChan <- true
+	}()
+
+	//wait for WaitGroup or Timeout
+	select {
+	case <-wgChan:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("timeout exceeded")
+	}
 }
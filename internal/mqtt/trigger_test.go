@@ -0,0 +1,538 @@
+package mqtt
+
+import (
+	"context"
+	"github.com/rainu/mqtt-executor/internal/cmd"
+	"github.com/rainu/mqtt-executor/internal/mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type publishedMessage struct {
+	topic      string
+	payload    string
+	properties PublishProperties
+}
+
+// fakeClient records all published messages and calls the subscription handlers directly
+type fakeClient struct {
+	lock      sync.Mutex
+	published []publishedMessage
+	handlers  map[string]MessageHandler
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool   { return true }
+func (doneToken) Error() error { return nil }
+
+func (f *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
+	return f.PublishWithProperties(topic, qos, retained, payload, PublishProperties{})
+}
+
+func (f *fakeClient) PublishWithProperties(topic string, _ byte, _ bool, payload interface{}, properties PublishProperties) Token {
+	content, _ := payloadBytes(payload)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.published = append(f.published, publishedMessage{topic: topic, payload: string(content), properties: properties})
+
+	return doneToken{}
+}
+
+func (f *fakeClient) Subscribe(topic string, _ byte, handler MessageHandler) Token {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.handlers == nil {
+		f.handlers = map[string]MessageHandler{}
+	}
+	f.handlers[topic] = handler
+	return doneToken{}
+}
+
+func (f *fakeClient) Unsubscribe(topics ...string) Token {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, topic := range topics {
+		delete(f.handlers, topic)
+	}
+	return doneToken{}
+}
+
+func (f *fakeClient) Disconnect(time.Duration) {}
+
+func (f *fakeClient) receive(topic, payload string) {
+	f.lock.Lock()
+	handler := f.handlers[topic]
+	f.lock.Unlock()
+
+	handler(Message{Topic: topic, Payload: []byte(payload)})
+}
+
+// messages returns the payloads of all messages which were published to the given topic
+func (f *fakeClient) messages(topic string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var payloads []string
+	for _, message := range f.published {
+		if message.topic == topic {
+			payloads = append(payloads, message.payload)
+		}
+	}
+	return payloads
+}
+
+func runTrigger(t *testing.T, concurrency *config.Concurrency, actions func(client *fakeClient, trigger *Trigger)) *fakeClient {
+	client := &fakeClient{}
+	trigger := &Trigger{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	trigger.Initialise(1, 1, []config.Trigger{{
+		Name:  "test",
+		Topic: "cmnd/test",
+		Command: config.Command{
+			Name:      "/bin/sh",
+			Arguments: []string{"-c", "sleep 0.3; echo done"},
+		},
+		Concurrency: concurrency,
+	}})
+
+	actions(client, trigger)
+
+	//wait until all executions are done
+	assert.Eventually(t, func() bool {
+		return !trigger.isCommandRunning("test")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, trigger.Close(time.Second))
+
+	return client
+}
+
+func TestTrigger_ConcurrencySkip(t *testing.T) {
+	client := runTrigger(t, nil, func(client *fakeClient, trigger *Trigger) {
+		client.receive("cmnd/test", "START")
+		client.receive("cmnd/test", "START")
+	})
+
+	assert.Equal(t, []string{"done"}, client.messages("cmnd/test/RESULT"))
+
+	//the state of the single executions is only published in parallel mode
+	assert.Empty(t, client.messages("cmnd/test/EXECUTION"))
+}
+
+func TestTrigger_ConcurrencyQueue(t *testing.T) {
+	client := runTrigger(t, &config.Concurrency{Mode: config.ConcurrencyQueue, Limit: 1}, func(client *fakeClient, trigger *Trigger) {
+		client.receive("cmnd/test", "START")
+		client.receive("cmnd/test", "START")
+		client.receive("cmnd/test", "START") //queue is full
+
+		assert.Eventually(t, func() bool {
+			return len(client.messages("cmnd/test/RESULT")) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	assert.Equal(t, []string{"done", "done"}, client.messages("cmnd/test/RESULT"))
+	assert.Equal(t, []string{"STOPPED", "RUNNING", "RUNNING", "STOPPED"}, client.messages("cmnd/test/STATE"))
+}
+
+func TestTrigger_ConcurrencyQueue_Stop(t *testing.T) {
+	client := runTrigger(t, &config.Concurrency{Mode: config.ConcurrencyQueue, Limit: 1}, func(client *fakeClient, trigger *Trigger) {
+		client.receive("cmnd/test", "START")
+		client.receive("cmnd/test", "START")
+		client.receive("cmnd/test", "STOP") //stops the running and discards the queued one
+	})
+
+	assert.Equal(t, []string{ResultInterrupted}, client.messages("cmnd/test/RESULT"))
+}
+
+func TestTrigger_ConcurrencyReplace(t *testing.T) {
+	client := runTrigger(t, &config.Concurrency{Mode: config.ConcurrencyReplace}, func(client *fakeClient, trigger *Trigger) {
+		client.receive("cmnd/test", "START")
+		time.Sleep(50 * time.Millisecond)
+		client.receive("cmnd/test", "START")
+
+		assert.Eventually(t, func() bool {
+			return len(client.messages("cmnd/test/RESULT")) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	assert.Equal(t, []string{ResultInterrupted, "done"}, client.messages("cmnd/test/RESULT"))
+	assert.Equal(t, []string{"STOPPED", "RUNNING", "RUNNING", "STOPPED"}, client.messages("cmnd/test/STATE"))
+}
+
+func TestTrigger_ConcurrencyParallel(t *testing.T) {
+	client := runTrigger(t, &config.Concurrency{Mode: config.ConcurrencyParallel, Limit: 2}, func(client *fakeClient, trigger *Trigger) {
+		client.receive("cmnd/test", "START")
+		client.receive("cmnd/test", "START")
+		client.receive("cmnd/test", "START") //limit reached
+
+		assert.Eventually(t, func() bool {
+			return len(client.messages("cmnd/test/RESULT")) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	results := client.messages("cmnd/test/RESULT")
+	assert.Len(t, results, 2)
+
+	//each result contains its own execution id
+	ids := map[string]bool{}
+	for _, result := range results {
+		parts := strings.SplitN(result, ";", 2)
+		assert.Len(t, parts, 2)
+		assert.Equal(t, "done", parts[1])
+		ids[parts[0]] = true
+	}
+	assert.Len(t, ids, 2)
+
+	//the state is the aggregate of all executions -> stopped only after the last one
+	assert.Equal(t, []string{"STOPPED", "RUNNING", "RUNNING", "STOPPED"}, client.messages("cmnd/test/STATE"))
+
+	//the state of each execution contains its id
+	expectedStates := []string{}
+	for id := range ids {
+		expectedStates = append(expectedStates, "RUNNING;"+id, "STOPPED;"+id)
+	}
+	assert.ElementsMatch(t, expectedStates, client.messages("cmnd/test/EXECUTION"))
+}
+
+func TestTrigger_PayloadRejected(t *testing.T) {
+	client := &fakeClient{}
+	trigger := &Trigger{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	trigger.Initialise(1, 1, []config.Trigger{{
+		Name:  "test",
+		Topic: "cmnd/test",
+		Command: config.Command{
+			Name:      "/bin/echo",
+			Arguments: []string{"${value}"},
+		},
+		Payload: &config.TriggerPayload{
+			Format: config.PayloadFormatText,
+			Mode:   config.PayloadModeArguments,
+			Schema: map[string]config.PayloadField{
+				config.PayloadValueField: {Enum: []string{"on", "off"}},
+			},
+		},
+	}})
+
+	client.receive("cmnd/test", "reboot")
+	client.receive("cmnd/test", "START") //the command's argument needs the value
+	client.receive("cmnd/test", "")      //an empty value is not part of the enum
+	client.receive("cmnd/test", "on")
+
+	assert.Eventually(t, func() bool {
+		return len(client.messages("cmnd/test/RESULT")) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, trigger.Close(time.Second))
+
+	assert.Equal(t, []string{
+		ResultRejected + ";invalid value of field value: not one of on, off",
+		ResultRejected + ";missing field: value",
+		ResultRejected + ";invalid value of field value: not one of on, off",
+		"on",
+	}, client.messages("cmnd/test/RESULT"))
+}
+
+func TestTrigger_Reload(t *testing.T) {
+	client := &fakeClient{}
+	trigger := &Trigger{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	command := config.Command{Name: "/bin/echo", Arguments: []string{"done"}}
+	trigger.Initialise(1, 1, []config.Trigger{
+		{Name: "unchanged", Topic: "cmnd/unchanged", Command: command},
+		{Name: "changed", Topic: "cmnd/changed", Command: command},
+		{Name: "removed", Topic: "cmnd/removed", Command: command},
+	})
+
+	trigger.Reload([]config.Trigger{
+		{Name: "unchanged", Topic: "cmnd/unchanged", Command: command},
+		{Name: "changed", Topic: "cmnd/changed/new", Command: command},
+		{Name: "added", Topic: "cmnd/added", Command: command},
+	})
+
+	client.lock.Lock()
+	var topics []string
+	for topic := range client.handlers {
+		topics = append(topics, topic)
+	}
+	client.lock.Unlock()
+	assert.ElementsMatch(t, []string{"cmnd/unchanged", "cmnd/changed/new", "cmnd/added"}, topics)
+
+	//only new or changed trigger publish their state again
+	assert.Equal(t, []string{"STOPPED"}, client.messages("cmnd/unchanged/STATE"))
+	assert.Equal(t, []string{"STOPPED"}, client.messages("cmnd/changed/new/STATE"))
+	assert.Equal(t, []string{"STOPPED"}, client.messages("cmnd/added/STATE"))
+
+	client.receive("cmnd/changed/new", "START")
+	assert.Eventually(t, func() bool {
+		return len(client.messages("cmnd/changed/new/RESULT")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, trigger.Close(time.Second))
+}
+
+func TestTrigger_RpcReplyTopic(t *testing.T) {
+	client := &fakeClient{}
+	trigger := &Trigger{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	trigger.Initialise(1, 1, []config.Trigger{{
+		Name:  "test",
+		Topic: "cmnd/test",
+		Command: config.Command{
+			Name:      "/bin/sh",
+			Arguments: []string{"-c", "sleep 0.3; echo done"},
+		},
+		Rpc:            true,
+		RpcReplyPrefix: "reply/",
+	}})
+
+	//invalid reply topics will not be used
+	client.receive("cmnd/test", `{"id": 1, "reply_to": "reply/#"}`)
+	client.receive("cmnd/test", `{"id": 2, "reply_to": "cmnd/other"}`)
+	assert.Equal(t, []string{
+		ResultRejected + ";invalid reply topic: invalid character",
+		ResultRejected + ";invalid reply topic: must start with reply/",
+	}, client.messages("cmnd/test/RESULT"))
+
+	//the MQTT 5 response topic is restricted too
+	client.lock.Lock()
+	handler := client.handlers["cmnd/test"]
+	client.lock.Unlock()
+	handler(Message{Topic: "cmnd/test", Payload: []byte("START"), ResponseTopic: "cmnd/other"})
+	assert.Equal(t, ResultRejected+";invalid reply topic: must start with reply/", client.messages("cmnd/test/RESULT")[2])
+	assert.Empty(t, client.messages("cmnd/other"))
+
+	//a STOP will be answered too
+	client.receive("cmnd/test", `{"id": 3, "reply_to": "reply/client", "payload": "STOP"}`)
+	client.receive("cmnd/test", `{"id": 4, "reply_to": "reply/client"}`)
+	client.receive("cmnd/test", `{"id": 5, "reply_to": "reply/client", "payload": "STOP"}`)
+
+	assert.Eventually(t, func() bool {
+		return len(client.messages("reply/client")) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, trigger.Close(time.Second))
+
+	assert.ElementsMatch(t, []string{
+		`{"id":3,"result":"<FAILED>;command is not running"}`,
+		`{"id":5,"result":"<INTERRUPTED>"}`,
+		`{"id":4,"result":"<INTERRUPTED>"}`,
+	}, client.messages("reply/client"))
+}
+
+func TestTrigger_CloseDiscardsQueue(t *testing.T) {
+	client := &fakeClient{}
+	trigger := &Trigger{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	trigger.Initialise(1, 1, []config.Trigger{{
+		Name:  "test",
+		Topic: "cmnd/test",
+		Command: config.Command{
+			Name:      "/bin/sh",
+			Arguments: []string{"-c", "sleep 0.3; echo done"},
+		},
+		Rpc:         true,
+		Concurrency: &config.Concurrency{Mode: config.ConcurrencyQueue, Limit: 1},
+	}})
+
+	client.receive("cmnd/test", `{"id": 1, "reply_to": "reply/client"}`)
+	client.receive("cmnd/test", `{"id": 2, "reply_to": "reply/client"}`)
+	assert.NoError(t, trigger.Close(time.Second))
+
+	//the running execution is finished normally but the queued one will never be started
+	assert.Eventually(t, func() bool {
+		return !trigger.isCommandRunning("test")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{
+		`{"id":2,"result":"<INTERRUPTED>"}`,
+		`{"id":1,"result":"done"}`,
+	}, client.messages("reply/client"))
+	assert.Equal(t, []string{"STOPPED", "RUNNING", "STOPPED"}, client.messages("cmnd/test/STATE"))
+}
+
+func TestTrigger_RunningAfterSlotGranted(t *testing.T) {
+	executor := cmd.NewCommandExecutor()
+	executor.SetLimits(1, nil)
+
+	client := &fakeClient{}
+	trigger := &Trigger{
+		Executor:   executor,
+		MqttClient: client,
+	}
+	trigger.Initialise(1, 1, []config.Trigger{{
+		Name:    "test",
+		Topic:   "cmnd/test",
+		Command: config.Command{Name: "/bin/echo", Arguments: []string{"done"}},
+	}})
+
+	//occupy the only slot
+	go executor.ExecuteWithContext(cmd.Execution{Name: "sleep", Arguments: []string{"0.3"}}, context.Background())
+	assert.Eventually(t, func() bool {
+		return executor.Metrics().Running == 1
+	}, time.Second, time.Millisecond)
+
+	client.receive("cmnd/test", "START")
+	assert.Eventually(t, func() bool {
+		return executor.Metrics().Waiting == 1
+	}, time.Second, time.Millisecond)
+
+	//the trigger is waiting for a free slot -> it is not running yet
+	assert.Equal(t, []string{"STOPPED"}, client.messages("cmnd/test/STATE"))
+
+	assert.Eventually(t, func() bool {
+		return len(client.messages("cmnd/test/RESULT")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, trigger.Close(time.Second))
+
+	assert.Eventually(t, func() bool {
+		return len(client.messages("cmnd/test/STATE")) == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"STOPPED", "RUNNING", "STOPPED"}, client.messages("cmnd/test/STATE"))
+}
+
+func TestTrigger_PayloadSchema(t *testing.T) {
+	client := &fakeClient{}
+	trigger := &Trigger{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	trigger.Initialise(1, 1, []config.Trigger{{
+		Name:  "test",
+		Topic: "cmnd/test",
+		Command: config.Command{
+			Name:      "/bin/sh",
+			Arguments: []string{"-c", `echo "${value}$MQTT_EXECUTOR_PROPERTY_USER"`},
+		},
+		Payload: &config.TriggerPayload{
+			Format: config.PayloadFormatText,
+			Mode:   config.PayloadModeArguments,
+			Schema: map[string]config.PayloadField{
+				config.PayloadValueField: {Required: true},
+			},
+		},
+	}})
+
+	//a simple START must fulfill the schema too
+	client.receive("cmnd/test", "START")
+	assert.Equal(t, []string{ResultRejected + ";missing field: value"}, client.messages("cmnd/test/RESULT"))
+
+	//the user properties are not passed if the input is restricted by a schema
+	client.lock.Lock()
+	handler := client.handlers["cmnd/test"]
+	client.lock.Unlock()
+	handler(Message{Topic: "cmnd/test", Payload: []byte("on"), UserProperties: map[string]string{"user": "; reboot"}})
+
+	assert.Eventually(t, func() bool {
+		return len(client.messages("cmnd/test/RESULT")) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, trigger.Close(time.Second))
+
+	assert.Equal(t, "on", client.messages("cmnd/test/RESULT")[1])
+}
+
+func TestTrigger_PlaceholderWithoutValue(t *testing.T) {
+	client := &fakeClient{}
+	trigger := &Trigger{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	trigger.Initialise(1, 1, []config.Trigger{{
+		Name:  "test",
+		Topic: "cmnd/test",
+		Command: config.Command{
+			Name:      "/bin/echo",
+			Arguments: []string{"set", "[${volume}]"},
+		},
+		Payload: &config.TriggerPayload{
+			Format: config.PayloadFormatJson,
+			Mode:   config.PayloadModeArguments,
+		},
+	}})
+
+	client.receive("cmnd/test", "START")
+	assert.Eventually(t, func() bool {
+		return len(client.messages("cmnd/test/RESULT")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client.receive("cmnd/test", `{"channel": "Master"}`)
+	assert.Eventually(t, func() bool {
+		return len(client.messages("cmnd/test/RESULT")) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, trigger.Close(time.Second))
+
+	//the placeholder itself is never passed to the command
+	assert.Equal(t, []string{"set []", "set []"}, client.messages("cmnd/test/RESULT"))
+}
+
+func TestTrigger_PayloadMalformed(t *testing.T) {
+	client := &fakeClient{}
+	trigger := &Trigger{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	trigger.Initialise(1, 1, []config.Trigger{{
+		Name:  "test",
+		Topic: "cmnd/test",
+		Command: config.Command{
+			Name:      "/bin/echo",
+			Arguments: []string{"${level}"},
+		},
+		Payload: &config.TriggerPayload{
+			Format: config.PayloadFormatJson,
+			Mode:   config.PayloadModeArguments,
+			Schema: map[string]config.PayloadField{
+				"level": {Enum: []string{"low", "high"}},
+			},
+		},
+	}})
+	defer trigger.Close(time.Second)
+
+	client.lock.Lock()
+	handler := client.handlers["cmnd/test"]
+	client.lock.Unlock()
+	handler(Message{Topic: "cmnd/test", Payload: []byte(`{"level": `), ResponseTopic: "reply/client"})
+
+	//the rejection is published to the result topic and the response topic of the caller
+	expected := []string{ResultRejected + ";invalid json payload: unexpected EOF"}
+	assert.Equal(t, expected, client.messages("cmnd/test/RESULT"))
+	assert.Equal(t, expected, client.messages("reply/client"))
+}
+
+func TestTrigger_Schedule(t *testing.T) {
+	client := &fakeClient{}
+	trigger := &Trigger{
+		Executor:   cmd.NewCommandExecutor(),
+		MqttClient: client,
+	}
+	trigger.Initialise(1, 1, []config.Trigger{{
+		Name:  "test",
+		Topic: "cmnd/test",
+		Command: config.Command{
+			Name:      "/bin/echo",
+			Arguments: []string{"done"},
+		},
+		Schedule: everySecond(t),
+	}})
+
+	//the scheduled executions are the same as an incoming START-Message
+	assert.Eventually(t, func() bool {
+		return len(client.messages("cmnd/test/RESULT")) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, trigger.Close(time.Second))
+
+	assert.Equal(t, []string{"done", "done"}, client.messages("cmnd/test/RESULT")[:2])
+	assert.Equal(t, []string{"STOPPED", "RUNNING", "STOPPED", "RUNNING", "STOPPED"}, client.messages("cmnd/test/STATE")[:5])
+}